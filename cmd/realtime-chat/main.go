@@ -13,20 +13,37 @@ import (
 	"RealtimeChat/internal/auth"
 	"RealtimeChat/internal/chat"
 	"RealtimeChat/internal/config"
+	"RealtimeChat/internal/cors"
+	"RealtimeChat/internal/health"
+	"RealtimeChat/internal/logging"
+	"RealtimeChat/internal/metrics"
+	"RealtimeChat/internal/migrate"
+	"RealtimeChat/internal/presence"
+	"RealtimeChat/internal/ratelimit"
 	"RealtimeChat/internal/shared"
-	"fmt"
-	"log"
+	"RealtimeChat/internal/tracing"
+	"RealtimeChat/internal/users"
+	"RealtimeChat/migrations"
+	"context"
+	"flag"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/redis/go-redis/v9"
+	"github.com/golang-jwt/jwt/v5"
 	httpSwagger "github.com/swaggo/http-swagger"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 
 func OnlineStatusUpdater(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        claims, ok := r.Context().Value("userClaims").(map[string]interface{}) 
+        claims, ok := r.Context().Value("userClaims").(jwt.MapClaims)
         var userID string
         if ok {
             if v, ok := claims["user_id"].(string); ok {
@@ -34,52 +51,190 @@ func OnlineStatusUpdater(next http.Handler) http.Handler {
             }
         }
         if userID != "" {
-            if err := shared.SetUserOnline(userID); err != nil {
-                log.Printf("Failed to set user online status: %v", err)
+            if err := shared.SetUserOnline(r.Context(), userID); err != nil {
+                slog.ErrorContext(r.Context(), "Failed to set user online status", "error", err)
             }
         }
         next.ServeHTTP(w, r)
     })
 }
 
+// traceHTTP starts a span for every request to next, named after the route
+// pattern of mux that matched. Probes and metrics scrapes are not traced.
+func traceHTTP(mux *http.ServeMux, next http.Handler) http.Handler {
+    return otelhttp.NewHandler(next, "http",
+        otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+            _, route := mux.Handler(r)
+            if route == "" {
+                route = "unmatched"
+            }
+            return r.Method + " " + route
+        }),
+        otelhttp.WithFilter(func(r *http.Request) bool {
+            switch r.URL.Path {
+            case "/healthz", "/readyz", "/metrics":
+                return false
+            }
+            return true
+        }),
+    )
+}
+
+// fatal logs err and exits. Deferred calls do not run.
+func fatal(msg string, err error, args ...any) {
+    slog.Error(msg, append([]any{"error", err}, args...)...)
+    os.Exit(1)
+}
+
 func main() {
-    cfg := config.MustLoad()
+    configPath := flag.String("config", "", "path to the YAML config (default $CONFIG_PATH or "+config.DefaultPath+")")
+    flag.Parse()
+
+    cfg, err := config.Load(*configPath)
+    if err != nil {
+        fatal("Failed to load config", err)
+    }
+    if _, err := logging.Setup(cfg.Log); err != nil {
+        fatal("Failed to set up logging", err)
+    }
+    shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
+    if err != nil {
+        fatal("Failed to set up tracing", err)
+    }
+    defer func() {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        if err := shutdownTracing(ctx); err != nil {
+            slog.Warn("Failed to flush traces", "error", err)
+        }
+    }()
+
+    if args := flag.Args(); len(args) > 0 && args[0] == "migrate" {
+        runMigrate(cfg, args[1:])
+        return
+    }
 
     db, err := shared.NewDB(cfg)
     if err != nil {
-        log.Fatalf("Failed to connect to database: %v", err)
+        fatal("Failed to connect to database", err)
     }
     defer db.Close()
 
-    if err := shared.LoadKeys("config/private.pem", "config/public.pem"); err != nil {
-        log.Fatalf("Failed to load JWT keys: %v", err)
+    // Background workers get their own context: they are stopped only after
+    // the HTTP and WebSocket clients are gone, and waited for before the
+    // database is closed.
+    workersCtx, stopWorkers := context.WithCancel(context.Background())
+    var workers sync.WaitGroup
+    goWorker := func(fn func(ctx context.Context)) {
+        workers.Add(1)
+        go func() {
+            defer workers.Done()
+            fn(workersCtx)
+        }()
+    }
+
+    migrationRunner, err := migrate.New(db.DB, migrations.FS)
+    if err != nil {
+        fatal("Failed to load migrations", err)
+    }
+    if cfg.Database.AutoMigrate {
+        if _, err := migrationRunner.Up(context.Background()); err != nil {
+            fatal("Failed to apply migrations", err)
+        }
+    }
+
+    if keys := cfg.Auth.SigningKeys; keys.Dir != "" {
+        if err := shared.LoadKeyDir(keys.Dir, keys.ActiveKeyID); err != nil {
+            fatal("Failed to load JWT keys", err)
+        }
+        goWorker(func(ctx context.Context) {
+            shared.WatchKeyDir(ctx, keys.Dir, keys.ActiveKeyID, keys.ReloadInterval)
+        })
+    } else if err := shared.LoadKeys("config/private.pem", "config/public.pem"); err != nil {
+        fatal("Failed to load JWT keys", err)
+    }
+    backend, err := shared.NewBackend(cfg)
+    if err != nil {
+        fatal("Failed to init state backend", err, "backend", cfg.State.Backend)
+    }
+    defer backend.Close()
+    shared.UseBackend(backend)
+
+    mailer := shared.NewMailer(cfg.Mail)
+    storage, err := shared.NewLocalStorage(cfg.Storage.Dir)
+    if err != nil {
+        fatal("Failed to init storage", err)
     }
-    addr := fmt.Sprintf("%s:%s", cfg.Redis.Host, cfg.Redis.Port)  
-    shared.InitRedis(addr, "", 0)
-    shared.RedisClient = redis.NewClient(&redis.Options{
-        Addr:   addr,
-        Password: "",
-        DB: 0,
-    })
 
-    authService := auth.NewService(db)
+    authService := auth.NewService(db, backend.KV, mailer, cfg)
     authHandler := auth.NewHandler(authService)
-    chatService := chat.NewService(db)
-    chatHandler := chat.NewHandler(chatService)
+    shared.SetAPITokenVerifier(authService.VerifyAPIToken)
+    chatService := chat.NewService(db, cfg, storage)
+    presenceService := presence.NewService(db, backend.Presence, backend.PubSub)
+    presenceHandler := presence.NewHandler(presenceService)
+    goWorker(func(ctx context.Context) { presenceService.PersistLastSeen(ctx, time.Minute) })
+    limiter := ratelimit.New(cfg.RateLimit, backend.RateLimit)
+    origins := cors.New(append([]string{cfg.Server.PublicURL}, cfg.Server.AllowedOrigins...)...)
+    chatHandler := chat.NewHandler(chatService, presenceService, backend.PubSub, limiter, origins)
+    goWorker(chatHandler.WatchPresence)
+    goWorker(chatHandler.WatchRevocations)
+    goWorker(chatHandler.WatchMessages)
+    usersService := users.NewService(db, cfg, storage)
+    shared.SetAccountDeletedChecker(usersService.AccountDeleted)
+    usersHandler := users.NewHandler(usersService)
+    goWorker(func(ctx context.Context) { usersService.RunJobs(ctx, 30*time.Second) })
+
+    checker := health.NewChecker()
+    checker.Add("postgres", db.PingContext)
+    if cfg.State.Backend == "redis" {
+        checker.Add("redis", backend.Ping)
+    }
+    checker.Add("storage", storage.Check)
+    checker.Add("migrations", migrationRunner.Check)
+
+    metrics.RegisterDB(db.DB)
+    metrics.RegisterWebSocketConnections(chatHandler.ConnectionCount)
 
+    http.HandleFunc("/healthz", checker.Healthz)
+    http.Handle("/metrics", metrics.Handler())
+    http.HandleFunc("/readyz", checker.Readyz)
     http.Handle("/swagger/", httpSwagger.WrapHandler)
+    http.HandleFunc("/.well-known/jwks.json", shared.JWKSHandler)
 
 
     http.Handle("/chats",
         shared.JWTMiddleware(
-            OnlineStatusUpdater(
-                http.HandlerFunc(chatHandler.GetUserChats),
+            shared.RequireScope(shared.ScopeMessagesRead,
+                OnlineStatusUpdater(http.HandlerFunc(chatHandler.GetUserChats)),
             ),
         ),
     )
 
-    http.HandleFunc("/register", authHandler.Register)
-    http.HandleFunc("/login", authHandler.Login)
+    http.Handle("/register", limiter.Limit(ratelimit.Auth, http.HandlerFunc(authHandler.Register)))
+    http.Handle("/login", limiter.Limit(ratelimit.Auth, http.HandlerFunc(authHandler.Login)))
+    http.Handle("/login/2fa", limiter.Limit(ratelimit.Auth, http.HandlerFunc(authHandler.LoginTwoFactor)))
+    http.Handle("/verify-email", limiter.Limit(ratelimit.Auth, http.HandlerFunc(authHandler.VerifyEmail)))
+    http.Handle("/oauth/", limiter.Limit(ratelimit.Auth, http.HandlerFunc(authHandler.OIDC)))
+    http.Handle("/2fa/enroll", shared.JWTMiddleware(shared.RequireSession(limiter.Limit(ratelimit.Auth, http.HandlerFunc(authHandler.EnrollTOTP)))))
+    http.Handle("/2fa/confirm", shared.JWTMiddleware(shared.RequireSession(limiter.Limit(ratelimit.Auth, http.HandlerFunc(authHandler.ConfirmTOTP)))))
+    http.Handle("/tokens", shared.JWTMiddleware(shared.RequireSession(http.HandlerFunc(authHandler.APITokens))))
+    http.Handle("/tokens/", shared.JWTMiddleware(shared.RequireSession(http.HandlerFunc(authHandler.APITokens))))
+    http.Handle("/bots", shared.JWTMiddleware(shared.RequireSession(http.HandlerFunc(authHandler.Bots))))
+
+    // Account settings and the social graph are managed from a user session;
+    // API tokens may only read profiles and presence.
+    http.Handle("/me", shared.JWTMiddleware(shared.RequireSession(OnlineStatusUpdater(http.HandlerFunc(usersHandler.Me)))))
+    http.Handle("/me/avatar", shared.JWTMiddleware(shared.RequireSession(OnlineStatusUpdater(http.HandlerFunc(usersHandler.Avatar)))))
+    http.Handle("/me/presence", shared.JWTMiddleware(shared.RequireSession(OnlineStatusUpdater(http.HandlerFunc(presenceHandler.Settings)))))
+    http.Handle("/presence", shared.JWTMiddleware(shared.RequireScope(shared.ScopeMessagesRead, OnlineStatusUpdater(http.HandlerFunc(presenceHandler.Presence)))))
+    http.Handle("/me/export", shared.JWTMiddleware(shared.RequireSession(http.HandlerFunc(usersHandler.Export))))
+    http.Handle("/me/jobs/", shared.JWTMiddleware(shared.RequireSession(http.HandlerFunc(usersHandler.Jobs))))
+    http.Handle("/blocks", shared.JWTMiddleware(shared.RequireSession(http.HandlerFunc(usersHandler.Relations))))
+    http.Handle("/blocks/", shared.JWTMiddleware(shared.RequireSession(http.HandlerFunc(usersHandler.Relations))))
+    http.Handle("/mutes", shared.JWTMiddleware(shared.RequireSession(http.HandlerFunc(usersHandler.Relations))))
+    http.Handle("/mutes/", shared.JWTMiddleware(shared.RequireSession(http.HandlerFunc(usersHandler.Relations))))
+    http.Handle("/users", shared.JWTMiddleware(shared.RequireScope(shared.ScopeMessagesRead, OnlineStatusUpdater(http.HandlerFunc(usersHandler.Search)))))
+    http.Handle("/users/", shared.JWTMiddleware(shared.RequireScope(shared.ScopeMessagesRead, OnlineStatusUpdater(http.HandlerFunc(usersHandler.User)))))
 
     http.Handle("/protected",
         shared.JWTMiddleware(
@@ -93,16 +248,18 @@ func main() {
 
     http.Handle("/messages/attachment",
         shared.JWTMiddleware(
-            OnlineStatusUpdater(
-                http.HandlerFunc(chatHandler.PostMessageWithAttachment),
+            shared.RequireScope(shared.ScopeMessagesWrite,
+                OnlineStatusUpdater(
+                    limiter.Limit(ratelimit.Attachments, http.HandlerFunc(chatHandler.PostMessageWithAttachment)),
+                ),
             ),
         ),
     )
 
     http.Handle("/messages/",
         shared.JWTMiddleware(
-            OnlineStatusUpdater(
-                http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            shared.RequireScope(shared.ScopeMessagesRead,
+                OnlineStatusUpdater(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
                     if r.Method != http.MethodGet {
                         http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
                         return
@@ -115,36 +272,86 @@ func main() {
                     }
                     email := path[len(prefix):]
                     chatHandler.GetConversationMessages(w, r, email)
-                }),
+                })),
             ),
         ),
     )
 
     http.Handle("/messages",
         shared.JWTMiddleware(
-            OnlineStatusUpdater(
-                http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-                    switch r.Method {
-                    case http.MethodPost:
-                        chatHandler.PostMessage(w, r)
-                    case http.MethodGet:
-                        chatHandler.GetMessages(w, r)
-                    default:
-                        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-                    }
-                }),
-            ),
+            http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                switch r.Method {
+                case http.MethodPost:
+                    shared.RequireScope(shared.ScopeMessagesWrite,
+                        OnlineStatusUpdater(limiter.Limit(ratelimit.Messages, http.HandlerFunc(chatHandler.PostMessage))),
+                    ).ServeHTTP(w, r)
+                case http.MethodGet:
+                    shared.RequireScope(shared.ScopeMessagesRead,
+                        OnlineStatusUpdater(http.HandlerFunc(chatHandler.GetMessages)),
+                    ).ServeHTTP(w, r)
+                default:
+                    http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                }
+            }),
         ),
     )
 
     http.Handle("/ws",
-        shared.JWTMiddleware(
-            OnlineStatusUpdater(
-                http.HandlerFunc(chatHandler.WebSocket),
+        shared.WebSocketAuth(
+            shared.RequireScope(shared.ScopeMessagesRead,
+                OnlineStatusUpdater(http.HandlerFunc(chatHandler.WebSocket)),
             ),
         ),
     )
 
-    log.Printf("Server starting on :%s", cfg.Server.Port)
-    log.Fatal(http.ListenAndServe(":"+cfg.Server.Port, nil))
+    http.Handle("/ws/ticket",
+        shared.JWTMiddleware(
+            shared.RequireScope(shared.ScopeMessagesRead, http.HandlerFunc(chatHandler.WebSocketTicket)),
+        ),
+    )
+
+    srv := &http.Server{
+        Addr:              ":" + cfg.Server.Port,
+        Handler:           logging.Middleware(origins.Middleware(traceHTTP(http.DefaultServeMux, metrics.InstrumentHTTP(http.DefaultServeMux)))),
+        ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+        ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+        ReadTimeout:       cfg.Server.ReadTimeout,
+        WriteTimeout:      cfg.Server.WriteTimeout,
+        IdleTimeout:       cfg.Server.IdleTimeout,
+    }
+
+    stop := make(chan os.Signal, 1)
+    signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+    serveErr := make(chan error, 1)
+    go func() {
+        slog.Info("Server starting", "addr", srv.Addr)
+        serveErr <- srv.ListenAndServe()
+    }()
+
+    select {
+    case err := <-serveErr:
+        fatal("Server failed", err)
+    case sig := <-stop:
+        slog.Info("Shutting down", "signal", sig.String())
+    }
+    checker.SetDraining()
+    time.Sleep(cfg.Server.ShutdownDelay)
+
+    ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+    defer cancel()
+    // Both run at once: Shutdown does not track upgraded connections.
+    var drain sync.WaitGroup
+    drain.Add(1)
+    go func() {
+        defer drain.Done()
+        chatHandler.Shutdown(ctx)
+    }()
+    if err := srv.Shutdown(ctx); err != nil {
+        slog.Warn("HTTP shutdown", "error", err)
+    }
+    drain.Wait()
+
+    stopWorkers()
+    workers.Wait()
+    slog.Info("Server stopped")
 }
\ No newline at end of file
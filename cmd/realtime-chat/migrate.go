@@ -0,0 +1,77 @@
+package main
+
+import (
+	"RealtimeChat/internal/config"
+	"RealtimeChat/internal/migrate"
+	"RealtimeChat/internal/shared"
+	"RealtimeChat/migrations"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+)
+
+const migrateUsage = `usage: realtime-chat migrate <command>
+
+commands:
+  up          apply all pending migrations
+  down [N]    roll back the last N migrations (default 1)
+  status      list migrations and when they were applied`
+
+// runMigrate implements the "migrate" subcommand.
+func runMigrate(cfg *config.Config, args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+
+	db, err := shared.NewDB(cfg)
+	if err != nil {
+		fatal("Failed to connect to database", err)
+	}
+	defer db.Close()
+
+	runner, err := migrate.New(db.DB, migrations.FS)
+	if err != nil {
+		fatal("Failed to load migrations", err)
+	}
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		n, err := runner.Up(ctx)
+		if err != nil {
+			fatal("Migration failed", err)
+		}
+		slog.Info("Migrations applied", "count", n)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				fmt.Fprintf(os.Stderr, "invalid number of steps: %s\n", args[1])
+				os.Exit(2)
+			}
+		}
+		n, err := runner.Down(ctx, steps)
+		if err != nil {
+			fatal("Rollback failed", err)
+		}
+		slog.Info("Migrations rolled back", "count", n)
+	case "status":
+		list, err := runner.Status(ctx)
+		for _, s := range list {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%03d  %-40s  %s\n", s.Version, s.Name, applied)
+		}
+		if err != nil {
+			fatal("Migration check failed", err)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,267 @@
+package auth
+
+import (
+    "context"
+    "crypto/rand"
+    "database/sql"
+    "encoding/hex"
+    "errors"
+    "regexp"
+    "strings"
+    "time"
+
+    "RealtimeChat/internal/shared"
+    "github.com/lib/pq"
+)
+
+const (
+    UserTypeHuman = "human"
+    UserTypeBot   = "bot"
+)
+
+// maxAPITokenNameLength matches api_tokens.name VARCHAR(100).
+const maxAPITokenNameLength = 100
+
+var (
+    ErrInvalidAPIToken = errors.New("invalid API token")
+    ErrInvalidScope    = errors.New("unknown scope")
+    ErrBotNotFound     = errors.New("bot not found")
+    ErrTokenNotFound   = errors.New("token not found")
+)
+
+// swagger:model Bot
+type Bot struct {
+    ID        string    `json:"id"`
+    Email     string    `json:"email" example:"deploy-notifier-1a2b3c@bots.invalid"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// swagger:model APIToken
+type APIToken struct {
+    ID         string     `json:"id"`
+    UserID     string     `json:"user_id"`
+    Name       string     `json:"name" example:"CI notifications"`
+    Prefix     string     `json:"prefix" example:"rtc_AbCdEf"`
+    Scopes     []string   `json:"scopes" example:"messages:write"`
+    ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+    LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+    RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+    CreatedAt  time.Time  `json:"created_at"`
+}
+
+// swagger:model CreatedAPIToken
+// Token is only ever returned once, at creation.
+type CreatedAPIToken struct {
+    APIToken
+    Token string `json:"token" example:"rtc_AbCdEf..."`
+}
+
+var botSlugRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// maxBotSlugLength keeps bot emails well within users.email VARCHAR(255).
+const maxBotSlugLength = 64
+
+// CreateBot creates a bot account owned by ownerID. Bots cannot log in with
+// a password and act only through API tokens.
+func (s *Service) CreateBot(ownerID, name string) (*Bot, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    suffix := make([]byte, 3)
+    if _, err := rand.Read(suffix); err != nil {
+        return nil, err
+    }
+    slug := strings.Trim(botSlugRe.ReplaceAllString(strings.ToLower(name), "-"), "-")
+    if len(slug) > maxBotSlugLength {
+        slug = strings.TrimRight(slug[:maxBotSlugLength], "-")
+    }
+    if slug == "" {
+        slug = "bot"
+    }
+    bot := &Bot{Email: slug + "-" + hex.EncodeToString(suffix) + "@bots.invalid"}
+
+    // "!" is not a valid bcrypt hash, so no password ever matches.
+    query := `INSERT INTO users (email, password_hash, user_type, owner_id, email_verified_at)
+              VALUES ($1, '!', $2, $3, NOW()) RETURNING id, created_at`
+    if err := s.db.QueryRowContext(ctx, query, bot.Email, UserTypeBot, ownerID).Scan(&bot.ID, &bot.CreatedAt); err != nil {
+        return nil, err
+    }
+    return bot, nil
+}
+
+func (s *Service) ListBots(ownerID string) ([]Bot, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    query := `SELECT id, email, created_at FROM users WHERE owner_id = $1 AND user_type = $2 ORDER BY created_at`
+    rows, err := s.db.QueryContext(ctx, query, ownerID, UserTypeBot)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    bots := []Bot{}
+    for rows.Next() {
+        var b Bot
+        if err := rows.Scan(&b.ID, &b.Email, &b.CreatedAt); err != nil {
+            return nil, err
+        }
+        bots = append(bots, b)
+    }
+    return bots, rows.Err()
+}
+
+// CreateAPIToken issues a token for callerID itself or, when botID is set,
+// for a bot owned by callerID. Only the SHA-256 hash of the token is stored.
+func (s *Service) CreateAPIToken(callerID, botID, name string, scopes []string, ttl time.Duration) (*CreatedAPIToken, error) {
+    for _, scope := range scopes {
+        if !validScope(scope) {
+            return nil, ErrInvalidScope
+        }
+    }
+    if len(scopes) == 0 {
+        return nil, ErrInvalidScope
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    userID := callerID
+    if botID != "" {
+        var exists bool
+        err := s.db.QueryRowContext(
+            ctx,
+            `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1 AND owner_id = $2 AND user_type = $3)`,
+            botID, callerID, UserTypeBot,
+        ).Scan(&exists)
+        if err != nil {
+            return nil, err
+        }
+        if !exists {
+            return nil, ErrBotNotFound
+        }
+        userID = botID
+    }
+
+    secret, err := randomURLToken()
+    if err != nil {
+        return nil, err
+    }
+    raw := shared.APITokenPrefix + secret
+
+    t := &CreatedAPIToken{
+        APIToken: APIToken{
+            UserID: userID,
+            Name:   name,
+            Prefix: raw[:len(shared.APITokenPrefix)+6],
+            Scopes: scopes,
+        },
+        Token: raw,
+    }
+    if ttl > 0 {
+        expiresAt := time.Now().Add(ttl)
+        t.ExpiresAt = &expiresAt
+    }
+
+    query := `INSERT INTO api_tokens (user_id, name, token_hash, token_prefix, scopes, expires_at)
+              VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at`
+    err = s.db.QueryRowContext(
+        ctx, query, userID, name, hashVerificationToken(raw), t.Prefix, pq.Array(scopes), t.ExpiresAt,
+    ).Scan(&t.ID, &t.CreatedAt)
+    if err != nil {
+        return nil, err
+    }
+    return t, nil
+}
+
+// ListAPITokens returns the tokens of callerID and of the bots it owns.
+func (s *Service) ListAPITokens(callerID string) ([]APIToken, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    query := `
+        SELECT t.id, t.user_id, t.name, t.token_prefix, t.scopes, t.expires_at, t.last_used_at, t.revoked_at, t.created_at
+        FROM api_tokens t
+        JOIN users u ON u.id = t.user_id
+        WHERE u.id = $1 OR u.owner_id = $1
+        ORDER BY t.created_at DESC
+    `
+    rows, err := s.db.QueryContext(ctx, query, callerID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    tokens := []APIToken{}
+    for rows.Next() {
+        var t APIToken
+        if err := rows.Scan(
+            &t.ID, &t.UserID, &t.Name, &t.Prefix, pq.Array(&t.Scopes),
+            &t.ExpiresAt, &t.LastUsedAt, &t.RevokedAt, &t.CreatedAt,
+        ); err != nil {
+            return nil, err
+        }
+        tokens = append(tokens, t)
+    }
+    return tokens, rows.Err()
+}
+
+// RevokeAPIToken revokes a token of callerID or of one of its bots and
+// closes the WebSocket connections opened with it.
+func (s *Service) RevokeAPIToken(callerID, tokenID string) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    query := `
+        UPDATE api_tokens SET revoked_at = NOW()
+        WHERE id = $2 AND revoked_at IS NULL
+          AND user_id IN (SELECT id FROM users WHERE id = $1 OR owner_id = $1)
+        RETURNING user_id
+    `
+    var userID string
+    err := s.db.QueryRowContext(ctx, query, callerID, tokenID).Scan(&userID)
+    if errors.Is(err, sql.ErrNoRows) {
+        return ErrTokenNotFound
+    }
+    if err != nil {
+        return err
+    }
+    return shared.AnnounceAPITokenRevoked(ctx, userID, tokenID)
+}
+
+// VerifyAPIToken implements shared.APITokenVerifier.
+func (s *Service) VerifyAPIToken(ctx context.Context, token string) (string, string, []string, error) {
+    ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+    defer cancel()
+
+    var id, userID string
+    var scopes []string
+    query := `
+        SELECT id, user_id, scopes FROM api_tokens
+        WHERE token_hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+    `
+    err := s.db.QueryRowContext(ctx, query, hashVerificationToken(token)).Scan(&id, &userID, pq.Array(&scopes))
+    if errors.Is(err, sql.ErrNoRows) {
+        return "", "", nil, ErrInvalidAPIToken
+    }
+    if err != nil {
+        return "", "", nil, err
+    }
+
+    // last_used_at is refreshed at most once a minute so that API calls do
+    // not each turn into a row write.
+    query = `UPDATE api_tokens SET last_used_at = NOW() WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`
+    if _, err := s.db.ExecContext(ctx, query, id); err != nil {
+        return "", "", nil, err
+    }
+    return id, userID, scopes, nil
+}
+
+func validScope(scope string) bool {
+    for _, s := range shared.Scopes {
+        if s == scope {
+            return true
+        }
+    }
+    return false
+}
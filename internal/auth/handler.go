@@ -1,34 +1,72 @@
 package auth
 
 import (
+    "RealtimeChat/internal/auth/models"
     "RealtimeChat/internal/shared"
     "encoding/json"
-    "log"
+    "errors"
+    "fmt"
+    "log/slog"
+    "math"
     "net/http"
+    "strconv"
+    "strings"
     "time"
-)
+    "unicode/utf8"
 
-// swagger:model Credentials
-type Credentials struct {
-    Email    string `json:"email"`
-    Password string `json:"password"`
-}
+    "github.com/golang-jwt/jwt/v5"
+    "github.com/google/uuid"
+)
 
 // swagger:model AuthResponse
+// When two-factor authentication is enabled Token is empty and MFAToken must
+// be exchanged at /login/2fa.
 type AuthResponse struct {
-    Token string `json:"token"`
+    Token       string `json:"token,omitempty"`
+    MFARequired bool   `json:"mfa_required,omitempty"`
+    MFAToken    string `json:"mfa_token,omitempty"`
+}
+
+// swagger:model TOTPConfirmRequest
+type TOTPConfirmRequest struct {
+    Code string `json:"code" example:"123456"`
+}
+
+// swagger:model RecoveryCodesResponse
+type RecoveryCodesResponse struct {
+    RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// swagger:model TwoFactorLoginRequest
+type TwoFactorLoginRequest struct {
+    MFAToken     string `json:"mfa_token"`
+    Code         string `json:"code,omitempty" example:"123456"`
+    RecoveryCode string `json:"recovery_code,omitempty" example:"abcde-fghij"`
 }
 
 type Handler struct {
-    service *Service
+    service   *Service
+    validator *requestValidator
 }
 
 func NewHandler(service *Service) *Handler {
     return &Handler{
-        service: service,
+        service:   service,
+        validator: newRequestValidator(service.cfg.Auth.Password),
     }
 }
 
+func writeLocked(w http.ResponseWriter, locked *LockedError) {
+    w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds()))))
+    http.Error(w, "Too many failed attempts", http.StatusTooManyRequests)
+}
+
+func writeValidationError(w http.ResponseWriter, fields []FieldError) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusBadRequest)
+    json.NewEncoder(w).Encode(ValidationErrorResponse{Error: "validation failed", Fields: fields})
+}
+
 // swagger:model User
 type User struct {
     ID        string    `json:"id" example:"123e4567-e89b-12d3-a456-426614174000"`
@@ -38,14 +76,17 @@ type User struct {
 }
 
 // @Summary Вход пользователя
-// @Description Проверяет email и пароль, возвращает JWT токен и фиксирует статус онлайн
+// @Description Проверяет email и пароль, возвращает JWT токен и фиксирует статус онлайн.
+// @Description Если включена 2FA, вместо токена возвращает mfa_token для /login/2fa
 // @Tags auth
 // @Accept json
 // @Produce json
-// @Param body body Credentials true "User credentials"
+// @Param body body models.LoginRequest true "User credentials"
 // @Success 200 {object} AuthResponse
-// @Failure 400 {string} string "Invalid request body"
+// @Failure 400 {object} ValidationErrorResponse
 // @Failure 401 {string} string "Invalid credentials"
+// @Failure 429 {string} string "Too many failed attempts"
+// @Header 429 {integer} Retry-After "Seconds until the lockout ends"
 // @Router /login [post]
 func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
     if r.Method != http.MethodPost {
@@ -53,24 +94,95 @@ func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    var creds Credentials
+    var creds models.LoginRequest
     if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
         http.Error(w, "Invalid request body", http.StatusBadRequest)
         return
     }
+    creds.Email = normalizeEmail(creds.Email)
+    if fields := h.validator.Struct(creds); fields != nil {
+        writeValidationError(w, fields)
+        return
+    }
 
-    token, err := h.service.Login(creds.Email, creds.Password)
-    if err != nil {
+    result, err := h.service.Login(creds.Email, creds.Password, shared.ClientIP(r))
+    var locked *LockedError
+    if errors.As(err, &locked) {
+        writeLocked(w, locked)
+        return
+    }
+    if errors.Is(err, ErrInvalidCredentials) {
         http.Error(w, "Invalid credentials", http.StatusUnauthorized)
         return
     }
+    if err != nil {
+        slog.ErrorContext(r.Context(), "Failed to log in", "error", err)
+        http.Error(w, "Failed to log in", http.StatusInternalServerError)
+        return
+    }
 
-    user, err := h.service.getUserByEmail(creds.Email)
+    w.Header().Set("Content-Type", "application/json")
+    if result.MFAToken != "" {
+        w.WriteHeader(http.StatusOK)
+        json.NewEncoder(w).Encode(AuthResponse{MFARequired: true, MFAToken: result.MFAToken})
+        return
+    }
+
+    if err := shared.SetUserOnline(r.Context(), result.UserID); err != nil {
+        slog.ErrorContext(r.Context(), "Failed to set user online", "error", err)
+    }
+
+    w.WriteHeader(http.StatusOK)
+    json.NewEncoder(w).Encode(AuthResponse{Token: result.Token})
+}
+
+// @Summary Второй шаг входа (2FA)
+// @Description Обменивает mfa_token и TOTP-код (или код восстановления) на JWT токен
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param body body TwoFactorLoginRequest true "MFA token and code"
+// @Success 200 {object} AuthResponse
+// @Failure 400 {string} string "Invalid request body"
+// @Failure 401 {string} string "Invalid code"
+// @Failure 429 {string} string "Too many failed attempts"
+// @Header 429 {integer} Retry-After "Seconds until the lockout ends"
+// @Router /login/2fa [post]
+func (h *Handler) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var req TwoFactorLoginRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+    if req.MFAToken == "" || (req.Code == "") == (req.RecoveryCode == "") {
+        http.Error(w, "mfa_token and either code or recovery_code are required", http.StatusBadRequest)
+        return
+    }
+
+    token, err := h.service.CompleteLogin(req.MFAToken, req.Code, req.RecoveryCode, shared.ClientIP(r))
+    var locked *LockedError
+    if errors.As(err, &locked) {
+        writeLocked(w, locked)
+        return
+    }
+    if errors.Is(err, ErrInvalidTOTPCode) {
+        http.Error(w, "Invalid code", http.StatusUnauthorized)
+        return
+    }
     if err != nil {
-        log.Printf("Failed to get user for online status: %v", err)
-    } else {
-        if err := shared.SetUserOnline(user.ID); err != nil {
-            log.Printf("Failed to set user online: %v", err)
+        slog.ErrorContext(r.Context(), "Failed to complete two-factor login", "error", err)
+        http.Error(w, "Failed to log in", http.StatusInternalServerError)
+        return
+    }
+
+    if userID, err := shared.ParseMFAToken(req.MFAToken); err == nil {
+        if err := shared.SetUserOnline(r.Context(), userID); err != nil {
+            slog.ErrorContext(r.Context(), "Failed to set user online", "error", err)
         }
     }
 
@@ -84,9 +196,9 @@ func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
 // @Tags auth
 // @Accept json
 // @Produce json
-// @Param body body Credentials true "User credentials"
+// @Param body body models.RegisterRequest true "User credentials"
 // @Success 201 {string} string "User created"
-// @Failure 400 {string} string "Invalid request body"
+// @Failure 400 {object} ValidationErrorResponse
 // @Failure 409 {string} string "User already exists"
 // @Router /register [post]
 func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
@@ -95,18 +207,396 @@ func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    var req Credentials
+    var req models.RegisterRequest
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
         http.Error(w, "Invalid request body", http.StatusBadRequest)
         return
     }
+    req.Email = normalizeEmail(req.Email)
+    if fields := h.validator.Struct(req); fields != nil {
+        writeValidationError(w, fields)
+        return
+    }
 
     err := h.service.Register(req.Email, req.Password)
+    if errors.Is(err, ErrUserExists) {
+        http.Error(w, "User already exists", http.StatusConflict)
+        return
+    }
     if err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
+        slog.ErrorContext(r.Context(), "Failed to register user", "error", err)
+        http.Error(w, "Failed to register user", http.StatusInternalServerError)
         return
     }
 
     w.WriteHeader(http.StatusCreated)
     w.Write([]byte("User created"))
-}
\ No newline at end of file
+}
+
+// @Summary Подтверждение email
+// @Description Подтверждает email пользователя по токену из письма
+// @Tags auth
+// @Produce plain
+// @Param token query string true "Verification token"
+// @Success 200 {string} string "Email verified"
+// @Failure 400 {string} string "Invalid or expired token"
+// @Router /verify-email [get]
+func (h *Handler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    token := r.URL.Query().Get("token")
+    if token == "" {
+        http.Error(w, "Token required", http.StatusBadRequest)
+        return
+    }
+
+    if err := h.service.VerifyEmail(token); err != nil {
+        if errors.Is(err, ErrInvalidVerificationToken) {
+            http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+            return
+        }
+        slog.ErrorContext(r.Context(), "Failed to verify email", "error", err)
+        http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusOK)
+    w.Write([]byte("Email verified"))
+}
+
+func userIDFromRequest(r *http.Request) (string, bool) {
+    claims, ok := r.Context().Value("userClaims").(jwt.MapClaims)
+    if !ok {
+        return "", false
+    }
+    userID := fmt.Sprintf("%v", claims["user_id"])
+    if userID == "" || userID == "<nil>" {
+        return "", false
+    }
+    return userID, true
+}
+
+// @Summary Подключение 2FA
+// @Description Генерирует TOTP-секрет и otpauth URI для приложения-аутентификатора. 2FA включается после подтверждения
+// @Tags auth
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} TOTPEnrollment
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 409 {string} string "Two-factor authentication already enabled"
+// @Router /2fa/enroll [post]
+func (h *Handler) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    userID, ok := userIDFromRequest(r)
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    enrollment, err := h.service.EnrollTOTP(userID)
+    if errors.Is(err, ErrTOTPAlreadyEnabled) {
+        http.Error(w, "Two-factor authentication already enabled", http.StatusConflict)
+        return
+    }
+    if err != nil {
+        slog.ErrorContext(r.Context(), "Failed to enroll TOTP", "error", err)
+        http.Error(w, "Failed to enroll two-factor authentication", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(enrollment)
+}
+
+// @Summary Подтверждение 2FA
+// @Description Включает 2FA по коду из приложения и возвращает одноразовые коды восстановления
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body TOTPConfirmRequest true "TOTP code"
+// @Success 200 {object} RecoveryCodesResponse
+// @Failure 400 {string} string "Invalid code"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 409 {string} string "Two-factor authentication already enabled"
+// @Router /2fa/confirm [post]
+func (h *Handler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    userID, ok := userIDFromRequest(r)
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    var req TOTPConfirmRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Invalid request body", http.StatusBadRequest)
+        return
+    }
+
+    codes, err := h.service.ConfirmTOTP(userID, req.Code)
+    switch {
+    case errors.Is(err, ErrTOTPAlreadyEnabled):
+        http.Error(w, "Two-factor authentication already enabled", http.StatusConflict)
+        return
+    case errors.Is(err, ErrTOTPNotEnrolled), errors.Is(err, ErrInvalidTOTPCode):
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    case err != nil:
+        slog.ErrorContext(r.Context(), "Failed to confirm TOTP", "error", err)
+        http.Error(w, "Failed to confirm two-factor authentication", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// @Summary Вход через OpenID Connect
+// @Description /oauth/{provider}/login перенаправляет к провайдеру (authorization code + PKCE),
+// @Description /oauth/{provider}/callback принимает ответ провайдера и возвращает JWT токен
+// @Tags auth
+// @Produce json
+// @Param provider path string true "Provider name from config"
+// @Param action path string true "login or callback"
+// @Success 200 {object} AuthResponse
+// @Success 302 "Redirect to the identity provider"
+// @Failure 400 {string} string "Invalid login state"
+// @Failure 401 {string} string "Login failed"
+// @Failure 404 {string} string "Unknown provider"
+// @Failure 409 {string} string "Email belongs to a bot account"
+// @Router /oauth/{provider}/{action} [get]
+func (h *Handler) OIDC(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/oauth/"), "/")
+    if len(parts) != 2 || parts[0] == "" {
+        http.NotFound(w, r)
+        return
+    }
+    provider, action := parts[0], parts[1]
+
+    switch action {
+    case "login":
+        authURL, err := h.service.OIDCAuthURL(r.Context(), provider)
+        if errors.Is(err, ErrUnknownOIDCProvider) {
+            http.Error(w, "Unknown provider", http.StatusNotFound)
+            return
+        }
+        if err != nil {
+            slog.ErrorContext(r.Context(), "Failed to start OIDC login", "provider", provider, "error", err)
+            http.Error(w, "Failed to start login", http.StatusBadGateway)
+            return
+        }
+        http.Redirect(w, r, authURL, http.StatusFound)
+    case "callback":
+        q := r.URL.Query()
+        if e := q.Get("error"); e != "" {
+            http.Error(w, "Login failed: "+e, http.StatusUnauthorized)
+            return
+        }
+        if q.Get("state") == "" || q.Get("code") == "" {
+            http.Error(w, "Invalid login state", http.StatusBadRequest)
+            return
+        }
+        result, err := h.service.OIDCCallback(r.Context(), provider, q.Get("state"), q.Get("code"))
+        switch {
+        case errors.Is(err, ErrUnknownOIDCProvider):
+            http.Error(w, "Unknown provider", http.StatusNotFound)
+            return
+        case errors.Is(err, ErrInvalidOIDCState):
+            http.Error(w, "Invalid login state", http.StatusBadRequest)
+            return
+        case errors.Is(err, ErrOIDCEmailNotVerified):
+            http.Error(w, err.Error(), http.StatusUnauthorized)
+            return
+        case errors.Is(err, ErrOIDCAccountConflict):
+            http.Error(w, err.Error(), http.StatusConflict)
+            return
+        case err != nil:
+            slog.ErrorContext(r.Context(), "OIDC callback failed", "provider", provider, "error", err)
+            http.Error(w, "Login failed", http.StatusUnauthorized)
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        if result.MFAToken != "" {
+            json.NewEncoder(w).Encode(AuthResponse{MFARequired: true, MFAToken: result.MFAToken})
+            return
+        }
+        if err := shared.SetUserOnline(r.Context(), result.UserID); err != nil {
+            slog.ErrorContext(r.Context(), "Failed to set user online", "error", err)
+        }
+        json.NewEncoder(w).Encode(AuthResponse{Token: result.Token})
+    default:
+        http.NotFound(w, r)
+    }
+}
+
+// swagger:model CreateAPITokenRequest
+type CreateAPITokenRequest struct {
+    Name string `json:"name" example:"CI notifications"`
+    // BotID issues the token for one of the caller's bots instead of the caller.
+    BotID         string   `json:"bot_id,omitempty"`
+    Scopes        []string `json:"scopes" example:"messages:read,messages:write"`
+    ExpiresInDays int      `json:"expires_in_days,omitempty" example:"90"`
+}
+
+// swagger:model CreateBotRequest
+type CreateBotRequest struct {
+    Name string `json:"name" example:"deploy-notifier"`
+}
+
+// @Summary Персональные API токены
+// @Description GET — список токенов пользователя и его ботов, POST — выпуск нового токена (значение возвращается один раз),
+// @Description DELETE /tokens/{id} — отзыв токена. Доступно только с пользовательской сессией
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body CreateAPITokenRequest false "Token to create (POST)"
+// @Success 200 {array} APIToken
+// @Success 201 {object} CreatedAPIToken
+// @Success 204 "Token revoked"
+// @Failure 400 {string} string "Invalid request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 404 {string} string "Not found"
+// @Router /tokens [get]
+// @Router /tokens [post]
+// @Router /tokens/{id} [delete]
+func (h *Handler) APITokens(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromRequest(r)
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+    tokenID := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/tokens"), "/")
+
+    switch {
+    case r.Method == http.MethodGet && tokenID == "":
+        tokens, err := h.service.ListAPITokens(userID)
+        if err != nil {
+            slog.ErrorContext(r.Context(), "Failed to list API tokens", "error", err)
+            http.Error(w, "Failed to list tokens", http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(tokens)
+    case r.Method == http.MethodPost && tokenID == "":
+        var req CreateAPITokenRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" || req.ExpiresInDays < 0 {
+            http.Error(w, "Invalid request body", http.StatusBadRequest)
+            return
+        }
+        if utf8.RuneCountInString(strings.TrimSpace(req.Name)) > maxAPITokenNameLength {
+            http.Error(w, fmt.Sprintf("Name must be at most %d characters long", maxAPITokenNameLength), http.StatusBadRequest)
+            return
+        }
+        if req.BotID != "" {
+            if _, err := uuid.Parse(req.BotID); err != nil {
+                http.Error(w, "Bot not found", http.StatusNotFound)
+                return
+            }
+        }
+        ttl := time.Duration(req.ExpiresInDays) * 24 * time.Hour
+        token, err := h.service.CreateAPIToken(userID, req.BotID, strings.TrimSpace(req.Name), req.Scopes, ttl)
+        switch {
+        case errors.Is(err, ErrInvalidScope):
+            http.Error(w, fmt.Sprintf("Scopes must be a non-empty subset of %v", shared.Scopes), http.StatusBadRequest)
+            return
+        case errors.Is(err, ErrBotNotFound):
+            http.Error(w, "Bot not found", http.StatusNotFound)
+            return
+        case err != nil:
+            slog.ErrorContext(r.Context(), "Failed to create API token", "error", err)
+            http.Error(w, "Failed to create token", http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(token)
+    case r.Method == http.MethodDelete && tokenID != "":
+        if _, err := uuid.Parse(tokenID); err != nil {
+            http.Error(w, "Token not found", http.StatusNotFound)
+            return
+        }
+        err := h.service.RevokeAPIToken(userID, tokenID)
+        if errors.Is(err, ErrTokenNotFound) {
+            http.Error(w, "Token not found", http.StatusNotFound)
+            return
+        }
+        if err != nil {
+            slog.ErrorContext(r.Context(), "Failed to revoke API token", "error", err)
+            http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// @Summary Боты
+// @Description GET — список ботов пользователя, POST — создание бота. Боты работают только через API токены
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body CreateBotRequest false "Bot to create (POST)"
+// @Success 200 {array} Bot
+// @Success 201 {object} Bot
+// @Failure 400 {string} string "Invalid request body"
+// @Failure 401 {string} string "Unauthorized"
+// @Router /bots [get]
+// @Router /bots [post]
+func (h *Handler) Bots(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromRequest(r)
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    switch r.Method {
+    case http.MethodGet:
+        bots, err := h.service.ListBots(userID)
+        if err != nil {
+            slog.ErrorContext(r.Context(), "Failed to list bots", "error", err)
+            http.Error(w, "Failed to list bots", http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(bots)
+    case http.MethodPost:
+        var req CreateBotRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+            http.Error(w, "Invalid request body", http.StatusBadRequest)
+            return
+        }
+        if utf8.RuneCountInString(strings.TrimSpace(req.Name)) > maxAPITokenNameLength {
+            http.Error(w, fmt.Sprintf("Name must be at most %d characters long", maxAPITokenNameLength), http.StatusBadRequest)
+            return
+        }
+        bot, err := h.service.CreateBot(userID, req.Name)
+        if err != nil {
+            slog.ErrorContext(r.Context(), "Failed to create bot", "error", err)
+            http.Error(w, "Failed to create bot", http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(bot)
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
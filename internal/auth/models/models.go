@@ -9,18 +9,25 @@ type User struct {
     ID           string    `json:"id" db:"id"`
     Email        string    `json:"email" db:"email"`
     PasswordHash string    `json:"-" db:"password_hash"` 
+    UserType     string    `json:"user_type" db:"user_type"`
+    OwnerID      *string   `json:"owner_id,omitempty" db:"owner_id"`
+    EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty" db:"email_verified_at"`
+    TOTPEnabledAt   *time.Time `json:"totp_enabled_at,omitempty" db:"totp_enabled_at"`
     CreatedAt    time.Time `json:"created_at" db:"created_at"`
     UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
 }
 
+// swagger:model LoginRequest
 type LoginRequest struct {
-    Email    string `json:"email" validate:"required,email"`
-    Password string `json:"password" validate:"required,min=8"`
+    Email    string `json:"email" validate:"required,email,max=255" example:"user@example.com"`
+    Password string `json:"password" validate:"required,maxbytes=72" example:"s3cretPassw0rd"`
 }
 
+// swagger:model RegisterRequest
+// Password strength is checked by the "password" rule against config.PasswordPolicy.
 type RegisterRequest struct {
-    Email    string `json:"email" validate:"required,email"`
-    Password string `json:"password" validate:"required,min=8"`
+    Email    string `json:"email" validate:"required,email,max=255" example:"user@example.com"`
+    Password string `json:"password" validate:"required,maxbytes=72,password" example:"s3cretPassw0rd"`
 }
 
 type AuthResponse struct {
@@ -35,6 +42,33 @@ type TokenClaims struct {
     Role   string `json:"role,omitempty"`
 }
 
+// swagger:model Profile
+type Profile struct {
+    ID          string    `json:"id" example:"123e4567-e89b-12d3-a456-426614174000"`
+    UserType    string    `json:"user_type" example:"human"`
+    DisplayName string    `json:"display_name,omitempty" example:"Анна"`
+    AvatarURL   string    `json:"avatar_url,omitempty" example:"/users/123e4567-e89b-12d3-a456-426614174000/avatar"`
+    Bio         string    `json:"bio,omitempty"`
+    Timezone    string    `json:"timezone,omitempty" example:"Europe/Moscow"`
+    CreatedAt   time.Time `json:"created_at"`
+}
+
+// swagger:model UserSummary
+// UserSummary is the compact profile embedded in messages and chat lists.
+type UserSummary struct {
+    ID          string `json:"id"`
+    DisplayName string `json:"display_name,omitempty"`
+    AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// AvatarURL is where the avatar of a user with an uploaded avatar is served.
+func AvatarURL(userID string, avatarPath *string) string {
+    if avatarPath == nil || *avatarPath == "" {
+        return ""
+    }
+    return "/users/" + userID + "/avatar"
+}
+
 // swagger:model Message
 type Message struct {
     ID              string     `json:"id" db:"id"`
@@ -62,6 +96,7 @@ type MessageWithAttachment struct {
     RecipientUserID *string         `json:"recipient_user_id,omitempty"`
     Content         string          `json:"content"`
     CreatedAt       time.Time       `json:"created_at"`
+    Sender          *UserSummary    `json:"sender,omitempty"`
     Attachment      *AttachmentInfo `json:"attachment,omitempty"`
 }
 // swagger:model AttachmentInfo
@@ -0,0 +1,292 @@
+package auth
+
+import (
+    "context"
+    "crypto/rand"
+    "database/sql"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "sync"
+    "time"
+
+    "RealtimeChat/internal/auth/models"
+    "RealtimeChat/internal/config"
+    "RealtimeChat/internal/shared"
+    "github.com/coreos/go-oidc/v3/oidc"
+    "golang.org/x/crypto/bcrypt"
+    "golang.org/x/oauth2"
+)
+
+const oidcStateTTL = 10 * time.Minute
+
+var (
+    ErrUnknownOIDCProvider  = errors.New("unknown identity provider")
+    ErrInvalidOIDCState     = errors.New("invalid or expired login state")
+    ErrOIDCEmailNotVerified = errors.New("identity provider did not return a verified email")
+    ErrOIDCAccountConflict  = errors.New("email belongs to an account that cannot log in with an identity provider")
+)
+
+// oidcProviders lazily runs discovery for each configured provider, so an
+// unreachable IdP does not prevent the server from starting.
+type oidcProviders struct {
+    cfg     map[string]config.OIDCProvider
+    mu      sync.Mutex
+    clients map[string]*oidcClient
+}
+
+type oidcClient struct {
+    oauth2   oauth2.Config
+    verifier *oidc.IDTokenVerifier
+}
+
+// oidcLoginState is kept in Redis between the redirect and the callback.
+type oidcLoginState struct {
+    Provider string `json:"provider"`
+    Verifier string `json:"verifier"`
+    Nonce    string `json:"nonce"`
+}
+
+func newOIDCProviders(cfg map[string]config.OIDCProvider) *oidcProviders {
+    return &oidcProviders{cfg: cfg, clients: make(map[string]*oidcClient)}
+}
+
+func (p *oidcProviders) get(name string) (*oidcClient, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    if c, ok := p.clients[name]; ok {
+        return c, nil
+    }
+    cfg, ok := p.cfg[name]
+    if !ok {
+        return nil, ErrUnknownOIDCProvider
+    }
+
+    // The context outlives this call: go-oidc keeps it for fetching keys.
+    ctx := oidc.ClientContext(context.Background(), &http.Client{Timeout: 10 * time.Second})
+    provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+    if err != nil {
+        return nil, fmt.Errorf("oidc discovery for %s: %w", name, err)
+    }
+    c := &oidcClient{
+        oauth2: oauth2.Config{
+            ClientID:     cfg.ClientID,
+            ClientSecret: cfg.ClientSecret,
+            RedirectURL:  cfg.RedirectURL,
+            Endpoint:     provider.Endpoint(),
+            Scopes:       append([]string{oidc.ScopeOpenID}, cfg.Scopes...),
+        },
+        verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+    }
+    p.clients[name] = c
+    return c, nil
+}
+
+// OIDCAuthURL starts an authorization-code flow with PKCE and returns the
+// provider URL the user must be redirected to.
+func (s *Service) OIDCAuthURL(ctx context.Context, provider string) (string, error) {
+    client, err := s.oidc.get(provider)
+    if err != nil {
+        return "", err
+    }
+
+    state, err := randomURLToken()
+    if err != nil {
+        return "", err
+    }
+    nonce, err := randomURLToken()
+    if err != nil {
+        return "", err
+    }
+    verifier := oauth2.GenerateVerifier()
+
+    data, err := json.Marshal(oidcLoginState{Provider: provider, Verifier: verifier, Nonce: nonce})
+    if err != nil {
+        return "", err
+    }
+    if err := s.kv.Set(ctx, "oidc:state:"+state, string(data), oidcStateTTL); err != nil {
+        return "", err
+    }
+
+    return client.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), nil
+}
+
+// OIDCCallback exchanges the authorization code, verifies the ID token and
+// logs in the user owning the provider identity or its verified email,
+// creating the account on first login. An unverified account with that email
+// is taken over by the IdP user.
+func (s *Service) OIDCCallback(ctx context.Context, provider, state, code string) (*LoginResult, error) {
+    data, err := s.kv.GetDel(ctx, "oidc:state:"+state)
+    if errors.Is(err, shared.ErrKeyNotFound) {
+        return nil, ErrInvalidOIDCState
+    }
+    if err != nil {
+        return nil, err
+    }
+    var st oidcLoginState
+    if err := json.Unmarshal([]byte(data), &st); err != nil || st.Provider != provider {
+        return nil, ErrInvalidOIDCState
+    }
+
+    client, err := s.oidc.get(provider)
+    if err != nil {
+        return nil, err
+    }
+    token, err := client.oauth2.Exchange(ctx, code, oauth2.VerifierOption(st.Verifier))
+    if err != nil {
+        return nil, fmt.Errorf("oidc code exchange: %w", err)
+    }
+    rawIDToken, ok := token.Extra("id_token").(string)
+    if !ok {
+        return nil, errors.New("oidc token response has no id_token")
+    }
+    idToken, err := client.verifier.Verify(ctx, rawIDToken)
+    if err != nil {
+        return nil, fmt.Errorf("oidc id_token verification: %w", err)
+    }
+    if idToken.Nonce != st.Nonce {
+        return nil, ErrInvalidOIDCState
+    }
+
+    var claims struct {
+        Email         string `json:"email"`
+        EmailVerified bool   `json:"email_verified"`
+    }
+    if err := idToken.Claims(&claims); err != nil {
+        return nil, err
+    }
+    if claims.Email == "" || !claims.EmailVerified {
+        return nil, ErrOIDCEmailNotVerified
+    }
+
+    user, err := s.linkOIDCUser(ctx, provider, idToken.Subject, normalizeEmail(claims.Email))
+    if err != nil {
+        return nil, err
+    }
+    return s.loginResult(user)
+}
+
+func (s *Service) linkOIDCUser(ctx context.Context, provider, subject, email string) (*models.User, error) {
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+
+    var user models.User
+    err = tx.QueryRowContext(
+        ctx,
+        `SELECT u.id, u.email, u.totp_enabled_at
+         FROM user_identities i JOIN users u ON u.id = i.user_id
+         WHERE i.provider = $1 AND i.subject = $2`,
+        provider, subject,
+    ).Scan(&user.ID, &user.Email, &user.TOTPEnabledAt)
+    if err == nil {
+        return &user, tx.Commit()
+    }
+    if !errors.Is(err, sql.ErrNoRows) {
+        return nil, err
+    }
+
+    // An existing account is only linked when its owner proved the address
+    // too. Otherwise whoever registered it first could keep a password or a
+    // session on the account the IdP user is about to log into.
+    var reclaimed bool
+    err = tx.QueryRowContext(
+        ctx,
+        `SELECT id, email, user_type, email_verified_at, totp_enabled_at FROM users WHERE lower(email) = $1 FOR UPDATE`,
+        email,
+    ).Scan(&user.ID, &user.Email, &user.UserType, &user.EmailVerifiedAt, &user.TOTPEnabledAt)
+    switch {
+    case errors.Is(err, sql.ErrNoRows):
+        hash, err := randomPasswordHash()
+        if err != nil {
+            return nil, err
+        }
+        user = models.User{Email: email}
+        err = tx.QueryRowContext(
+            ctx,
+            `INSERT INTO users (email, password_hash, email_verified_at) VALUES ($1, $2, NOW()) RETURNING id`,
+            email, hash,
+        ).Scan(&user.ID)
+        if err != nil {
+            return nil, err
+        }
+    case err != nil:
+        return nil, err
+    case user.UserType == UserTypeBot:
+        return nil, ErrOIDCAccountConflict
+    case user.EmailVerifiedAt == nil:
+        if err := reclaimUnverifiedUser(ctx, tx, user.ID); err != nil {
+            return nil, err
+        }
+        user.TOTPEnabledAt = nil
+        reclaimed = true
+    }
+
+    query := `INSERT INTO user_identities (provider, subject, user_id) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`
+    if _, err := tx.ExecContext(ctx, query, provider, subject, user.ID); err != nil {
+        return nil, err
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, err
+    }
+    if reclaimed {
+        if err := shared.RevokeUserTokens(ctx, user.ID); err != nil {
+            return nil, err
+        }
+    }
+    return &user, nil
+}
+
+// reclaimUnverifiedUser hands an account whose email was never verified to
+// the IdP user that just proved owning it: the password, second factor and
+// API tokens set up by whoever registered it stop working.
+func reclaimUnverifiedUser(ctx context.Context, tx *sql.Tx, userID string) error {
+    hash, err := randomPasswordHash()
+    if err != nil {
+        return err
+    }
+    query := `UPDATE users
+              SET password_hash = $2, email_verified_at = NOW(),
+                  totp_secret = NULL, totp_enabled_at = NULL, totp_last_counter = NULL, updated_at = NOW()
+              WHERE id = $1`
+    if _, err := tx.ExecContext(ctx, query, userID, hash); err != nil {
+        return err
+    }
+    if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+        return err
+    }
+    if _, err := tx.ExecContext(ctx, `DELETE FROM email_verification_tokens WHERE user_id = $1`, userID); err != nil {
+        return err
+    }
+    query = `UPDATE api_tokens SET revoked_at = NOW()
+             WHERE revoked_at IS NULL AND user_id IN (SELECT id FROM users WHERE id = $1 OR owner_id = $1)`
+    _, err = tx.ExecContext(ctx, query, userID)
+    return err
+}
+
+// randomPasswordHash is the password of accounts created or reclaimed through
+// an IdP: a random secret nobody knows.
+func randomPasswordHash() (string, error) {
+    secret, err := randomURLToken()
+    if err != nil {
+        return "", err
+    }
+    hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+    if err != nil {
+        return "", err
+    }
+    return string(hash), nil
+}
+
+func randomURLToken() (string, error) {
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,403 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"RealtimeChat/internal/config"
+	"RealtimeChat/internal/shared"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	mockProvider = "mock"
+	mockClientID = "realtime-chat"
+)
+
+// mockIdP is a minimal OpenID provider: discovery, JWKS and a token endpoint
+// that enforces PKCE. Codes are handed out by authorize instead of a login page.
+type mockIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]mockGrant
+}
+
+type mockGrant struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key, grants: make(map[string]mockGrant)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": "mock",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// authorize plays the user approving the login at authURL and returns the
+// state and code the provider would redirect back with.
+func (idp *mockIdP) authorize(t *testing.T, authURL string, claims jwt.MapClaims) (state, code string) {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("auth URL without S256 code challenge: %s", authURL)
+	}
+
+	grant := mockGrant{challenge: q.Get("code_challenge"), claims: jwt.MapClaims{
+		"iss":   idp.URL,
+		"aud":   mockClientID,
+		"nonce": q.Get("nonce"),
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+	}}
+	for k, v := range claims {
+		grant.claims[k] = v
+	}
+	code = base64.RawURLEncoding.EncodeToString([]byte(q.Get("state")))
+
+	idp.mu.Lock()
+	idp.grants[code] = grant
+	idp.mu.Unlock()
+	return q.Get("state"), code
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	grant, ok := idp.grants[r.PostFormValue("code")]
+	delete(idp.grants, r.PostFormValue("code"))
+	idp.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, grant.claims)
+	token.Header["kid"] = "mock"
+	idToken, err := token.SignedString(idp.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "mock-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func newOIDCTestService(t *testing.T, idp *mockIdP) (*Service, sqlmock.Sqlmock) {
+	t.Helper()
+	s, mock := newTestService(t, time.Now())
+	s.kv = shared.NewMemoryKeyValue()
+	s.cfg = &config.Config{Auth: config.Auth{MFATokenTTL: 5 * time.Minute}}
+	s.oidc = newOIDCProviders(map[string]config.OIDCProvider{mockProvider: {
+		Issuer:       idp.URL,
+		ClientID:     mockClientID,
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost/oauth/mock/callback",
+	}})
+	return s, mock
+}
+
+// login runs the whole flow for an IdP user with the given claims.
+func login(t *testing.T, s *Service, idp *mockIdP, claims jwt.MapClaims) (*LoginResult, error) {
+	t.Helper()
+	authURL, err := s.OIDCAuthURL(t.Context(), mockProvider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, code := idp.authorize(t, authURL, claims)
+	return s.OIDCCallback(t.Context(), mockProvider, state, code)
+}
+
+func verifiedClaims(subject, email string) jwt.MapClaims {
+	return jwt.MapClaims{"sub": subject, "email": email, "email_verified": true}
+}
+
+var (
+	selectIdentity = regexp.QuoteMeta(`FROM user_identities i JOIN users u ON u.id = i.user_id`)
+	selectByEmail  = regexp.QuoteMeta(`SELECT id, email, user_type, email_verified_at, totp_enabled_at FROM users WHERE lower(email) = $1 FOR UPDATE`)
+	insertIdentity = regexp.QuoteMeta(`INSERT INTO user_identities`)
+	userColumns    = []string{"id", "email", "user_type", "email_verified_at", "totp_enabled_at"}
+)
+
+func TestOIDCCallbackRejectsBadState(t *testing.T) {
+	idp := newMockIdP(t)
+	s, mock := newOIDCTestService(t, idp)
+	ctx := t.Context()
+
+	authURL, err := s.OIDCAuthURL(ctx, mockProvider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, code := idp.authorize(t, authURL, verifiedClaims("sub-1", "alice@example.com"))
+
+	if _, err := s.OIDCCallback(ctx, mockProvider, "forged-state", code); !errors.Is(err, ErrInvalidOIDCState) {
+		t.Errorf("unknown state: err = %v, want ErrInvalidOIDCState", err)
+	}
+	// A state is bound to the provider it was issued for and usable once.
+	if _, err := s.OIDCCallback(ctx, "other", state, code); !errors.Is(err, ErrInvalidOIDCState) {
+		t.Errorf("other provider: err = %v, want ErrInvalidOIDCState", err)
+	}
+	if _, err := s.OIDCCallback(ctx, mockProvider, state, code); !errors.Is(err, ErrInvalidOIDCState) {
+		t.Errorf("reused state: err = %v, want ErrInvalidOIDCState", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOIDCCallbackRejectsPKCEMismatch(t *testing.T) {
+	idp := newMockIdP(t)
+	s, mock := newOIDCTestService(t, idp)
+	ctx := t.Context()
+
+	// The code of one login presented with the state, and so the verifier,
+	// of another must not be redeemable.
+	victimURL, err := s.OIDCAuthURL(ctx, mockProvider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, code := idp.authorize(t, victimURL, verifiedClaims("sub-1", "alice@example.com"))
+	attackerURL, err := s.OIDCAuthURL(ctx, mockProvider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attackerState, _ := idp.authorize(t, attackerURL, verifiedClaims("sub-2", "mallory@example.com"))
+
+	result, err := s.OIDCCallback(ctx, mockProvider, attackerState, code)
+	if err == nil {
+		t.Fatalf("code redeemed with another login's verifier: %+v", result)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOIDCCallbackRejectsNonceMismatch(t *testing.T) {
+	idp := newMockIdP(t)
+	s, mock := newOIDCTestService(t, idp)
+
+	claims := verifiedClaims("sub-1", "alice@example.com")
+	claims["nonce"] = "replayed-nonce"
+	if _, err := login(t, s, idp, claims); !errors.Is(err, ErrInvalidOIDCState) {
+		t.Errorf("err = %v, want ErrInvalidOIDCState", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOIDCCallbackRequiresVerifiedEmail(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+	}{
+		{"unverified", jwt.MapClaims{"sub": "sub-1", "email": "alice@example.com", "email_verified": false}},
+		{"missing flag", jwt.MapClaims{"sub": "sub-1", "email": "alice@example.com"}},
+		{"no email", jwt.MapClaims{"sub": "sub-1", "email_verified": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newMockIdP(t)
+			s, mock := newOIDCTestService(t, idp)
+
+			if _, err := login(t, s, idp, tt.claims); !errors.Is(err, ErrOIDCEmailNotVerified) {
+				t.Errorf("err = %v, want ErrOIDCEmailNotVerified", err)
+			}
+			// No account is looked up, linked or created.
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackKnownIdentity(t *testing.T) {
+	idp := newMockIdP(t)
+	s, mock := newOIDCTestService(t, idp)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectIdentity).WithArgs(mockProvider, "sub-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "totp_enabled_at"}).AddRow("user-1", "alice@example.com", nil))
+	mock.ExpectCommit()
+
+	result, err := login(t, s, idp, verifiedClaims("sub-1", "alice@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.UserID != "user-1" || result.Token == "" {
+		t.Errorf("result = %+v, want a token for user-1", result)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOIDCCallbackLinksVerifiedAccount(t *testing.T) {
+	idp := newMockIdP(t)
+	s, mock := newOIDCTestService(t, idp)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectIdentity).WithArgs(mockProvider, "sub-1").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(selectByEmail).WithArgs("alice@example.com").
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow("user-1", "Alice@example.com", UserTypeHuman, time.Now(), nil))
+	mock.ExpectExec(insertIdentity).WithArgs(mockProvider, "sub-1", "user-1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	// The IdP email is matched case-insensitively.
+	result, err := login(t, s, idp, verifiedClaims("sub-1", "ALICE@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.UserID != "user-1" || result.Token == "" {
+		t.Errorf("result = %+v, want a token for user-1", result)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOIDCCallbackReclaimsUnverifiedAccount(t *testing.T) {
+	shared.UseBackend(shared.NewMemoryBackend())
+	idp := newMockIdP(t)
+	s, mock := newOIDCTestService(t, idp)
+
+	// Someone registered the address without verifying it and set up a
+	// second factor; the IdP user must not be challenged by it nor share the
+	// account with them.
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectIdentity).WithArgs(mockProvider, "sub-1").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(selectByEmail).WithArgs("alice@example.com").
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow("user-1", "alice@example.com", UserTypeHuman, nil, time.Now()))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE users SET password_hash = $2, email_verified_at = NOW(), totp_secret = NULL, totp_enabled_at = NULL`)).
+		WithArgs("user-1", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM recovery_codes WHERE user_id = $1`)).
+		WithArgs("user-1").WillReturnResult(sqlmock.NewResult(0, 10))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM email_verification_tokens WHERE user_id = $1`)).
+		WithArgs("user-1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE api_tokens SET revoked_at = NOW()`)).
+		WithArgs("user-1").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(insertIdentity).WithArgs(mockProvider, "sub-1", "user-1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	oldToken, err := shared.GenerateToken("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Revocation has whole-second granularity.
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+
+	result, err := login(t, s, idp, verifiedClaims("sub-1", "alice@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Token == "" || result.MFAToken != "" {
+		t.Errorf("result = %+v, want a token without 2FA challenge", result)
+	}
+	if _, err := shared.ParseAccessToken(t.Context(), oldToken); !errors.Is(err, shared.ErrTokenRevoked) {
+		t.Errorf("session of the previous owner: err = %v, want ErrTokenRevoked", err)
+	}
+	if _, err := shared.ParseAccessToken(t.Context(), result.Token); err != nil {
+		t.Errorf("new session: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOIDCCallbackRefusesBotAccount(t *testing.T) {
+	idp := newMockIdP(t)
+	s, mock := newOIDCTestService(t, idp)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectIdentity).WithArgs(mockProvider, "sub-1").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(selectByEmail).WithArgs("deploy-1a2b3c@bots.invalid").
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow("bot-1", "deploy-1a2b3c@bots.invalid", UserTypeBot, time.Now(), nil))
+	mock.ExpectRollback()
+
+	if _, err := login(t, s, idp, verifiedClaims("sub-1", "deploy-1a2b3c@bots.invalid")); !errors.Is(err, ErrOIDCAccountConflict) {
+		t.Errorf("err = %v, want ErrOIDCAccountConflict", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOIDCCallbackCreatesAccount(t *testing.T) {
+	idp := newMockIdP(t)
+	s, mock := newOIDCTestService(t, idp)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectIdentity).WithArgs(mockProvider, "sub-1").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(selectByEmail).WithArgs("bob@example.com").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO users (email, password_hash, email_verified_at) VALUES ($1, $2, NOW())`)).
+		WithArgs("bob@example.com", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-2"))
+	mock.ExpectExec(insertIdentity).WithArgs(mockProvider, "sub-1", "user-2").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	result, err := login(t, s, idp, verifiedClaims("sub-1", " Bob@Example.com "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.UserID != "user-2" || result.Token == "" {
+		t.Errorf("result = %+v, want a token for user-2", result)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
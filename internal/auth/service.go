@@ -2,54 +2,179 @@ package auth
 
 import (
     "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/base64"
+    "encoding/hex"
     "errors"
+    "fmt"
+    "log/slog"
+    "net/url"
     "time"
 
     "RealtimeChat/internal/auth/models"
+    "RealtimeChat/internal/config"
     "RealtimeChat/internal/shared"
+    "github.com/lib/pq"
     "golang.org/x/crypto/bcrypt"
 )
 
+var (
+    ErrInvalidCredentials       = errors.New("invalid credentials")
+    ErrUserExists               = errors.New("user already exists")
+    ErrInvalidVerificationToken = errors.New("invalid or expired verification token")
+)
+
 type Service struct {
-    db *shared.DB
+    db       *shared.DB
+    kv       shared.KeyValue
+    mailer   shared.Mailer
+    cfg      *config.Config
+    throttle *loginThrottle
+    oidc     *oidcProviders
+    // dummyHash is compared against when the email is unknown so that the
+    // response time does not reveal whether an account exists.
+    dummyHash string
+    // now is the clock used for time-based one-time codes.
+    now func() time.Time
 }
 
-func NewService(db *shared.DB) *Service {
-    return &Service{db: db}
+func NewService(db *shared.DB, kv shared.KeyValue, mailer shared.Mailer, cfg *config.Config) *Service {
+    dummyHash, err := bcrypt.GenerateFromPassword([]byte("timing-equalization"), bcrypt.DefaultCost)
+    if err != nil {
+        slog.Error("Failed to generate dummy password hash", "error", err)
+    }
+    return &Service{
+        db:        db,
+        kv:        kv,
+        mailer:    mailer,
+        cfg:       cfg,
+        throttle:  newLoginThrottle(kv, cfg.Auth.Throttle),
+        oidc:      newOIDCProviders(cfg.Auth.OIDCProviders),
+        dummyHash: string(dummyHash),
+        now:       time.Now,
+    }
 }
 
-func (s *Service) Login(email, password string) (string, error) {
-    user, err := s.getUserByEmail(email)
+// LoginResult holds either the final access token or, when the account has
+// two-factor authentication enabled, a challenge token for CompleteLogin.
+type LoginResult struct {
+    UserID   string
+    Token    string
+    MFAToken string
+}
+
+// Login checks the credentials of a user connecting from ip. Repeated
+// failures lock the email and the ip out with a *LockedError.
+func (s *Service) Login(email, password, ip string) (*LoginResult, error) {
+    email = normalizeEmail(email)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    emailKey := emailThrottleKey(email)
+    retryAfter, err := s.throttle.check(ctx, emailKey, ipThrottleKey(ip))
     if err != nil {
-        return "", err
+        slog.ErrorContext(ctx, "Login throttle check failed", "error", err)
+    }
+    if retryAfter > 0 {
+        s.recordFailedAttempt(email, "", ip, "locked")
+        return nil, &LockedError{RetryAfter: retryAfter}
+    }
+
+    user, err := s.getUserByEmail(email)
+    if err != nil && !errors.Is(err, sql.ErrNoRows) {
+        return nil, err
+    }
+    if user == nil {
+        checkPasswordHash(password, s.dummyHash)
+        s.loginFailed(ctx, emailKey, email, "", ip, "unknown_email")
+        return nil, ErrInvalidCredentials
     }
 
-    if !checkPasswordHash(password, user.PasswordHash) {
-        return "", errors.New("invalid credentials")
+    // Bots have no password hash; compare against the dummy one so the
+    // response time does not tell bot emails apart.
+    hash := user.PasswordHash
+    if user.UserType == UserTypeBot {
+        hash = s.dummyHash
+    }
+    if !checkPasswordHash(password, hash) || user.UserType == UserTypeBot {
+        s.loginFailed(ctx, emailKey, email, user.ID, ip, "bad_password")
+        return nil, ErrInvalidCredentials
+    }
+
+    if err := s.throttle.reset(ctx, emailKey); err != nil {
+        slog.ErrorContext(ctx, "Login throttle reset failed", "error", err)
+    }
+
+    return s.loginResult(user)
+}
+
+// loginResult issues the access token for an authenticated user, or a 2FA
+// challenge when the account has TOTP enabled.
+func (s *Service) loginResult(user *models.User) (*LoginResult, error) {
+    if user.TOTPEnabledAt != nil {
+        mfaToken, err := shared.GenerateMFAToken(user.ID, s.cfg.Auth.MFATokenTTL)
+        if err != nil {
+            return nil, err
+        }
+        return &LoginResult{UserID: user.ID, MFAToken: mfaToken}, nil
     }
 
     token, err := shared.GenerateToken(user.ID)
     if err != nil {
-        return "", err
+        return nil, err
+    }
+
+    return &LoginResult{UserID: user.ID, Token: token}, nil
+}
+
+// loginFailed counts a failed attempt against the account key (email or
+// pending 2FA login) and the client ip, and writes it to the audit log.
+func (s *Service) loginFailed(ctx context.Context, accountKey, email, userID, ip, reason string) {
+    limits := s.cfg.Auth.Throttle
+    if _, err := s.throttle.fail(ctx, accountKey, limits.MaxAttemptsPerEmail); err != nil {
+        slog.ErrorContext(ctx, "Login throttle update failed", "error", err)
+    }
+    if _, err := s.throttle.fail(ctx, ipThrottleKey(ip), limits.MaxAttemptsPerIP); err != nil {
+        slog.ErrorContext(ctx, "Login throttle update failed", "error", err)
     }
+    s.recordFailedAttempt(email, userID, ip, reason)
+}
+
+func (s *Service) recordFailedAttempt(email, userID, ip, reason string) {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
 
-    return token, nil
+    query := `INSERT INTO login_attempts (email, user_id, ip, reason) VALUES (NULLIF($1, ''), NULLIF($2, '')::uuid, $3, $4)`
+    if _, err := s.db.ExecContext(ctx, query, email, userID, ip, reason); err != nil {
+        slog.ErrorContext(ctx, "Failed to record login attempt", "error", err)
+    }
 }
 
 func (s *Service) createUser(user *models.User) error {
     ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
     defer cancel()
 
-    query := `INSERT INTO users (email, password_hash) VALUES ($1, $2)`
-    _, err := s.db.ExecContext(ctx, query, user.Email, user.PasswordHash)
+    query := `INSERT INTO users (email, password_hash) VALUES ($1, $2) RETURNING id`
+    err := s.db.QueryRowContext(ctx, query, user.Email, user.PasswordHash).Scan(&user.ID)
+    var pqErr *pq.Error
+    if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+        return ErrUserExists
+    }
     return err
 }
 
 func (s *Service) Register(email, password string) error {
+    email = normalizeEmail(email)
 
     _, err := s.getUserByEmail(email)
     if err == nil {
-        return errors.New("user already exists")
+        return ErrUserExists
+    }
+    if !errors.Is(err, sql.ErrNoRows) {
+        return err
     }
 
     hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -61,18 +186,93 @@ func (s *Service) Register(email, password string) error {
         Email:        email,
         PasswordHash: string(hash),
     }
-    return s.createUser(user)
+    if err := s.createUser(user); err != nil {
+        return err
+    }
+
+    // The account already exists at this point, so a mail failure must not
+    // fail the registration; the user can still log in.
+    if err := s.sendVerificationEmail(user); err != nil {
+        slog.Error("Failed to send verification email", "user_id", user.ID, "error", err)
+    }
+    return nil
+}
+
+func (s *Service) sendVerificationEmail(user *models.User) error {
+    token, err := generateVerificationToken()
+    if err != nil {
+        return err
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    query := `INSERT INTO email_verification_tokens (token_hash, user_id, expires_at) VALUES ($1, $2, $3)`
+    expiresAt := time.Now().Add(s.cfg.Auth.VerificationTokenTTL)
+    if _, err := s.db.ExecContext(ctx, query, hashVerificationToken(token), user.ID, expiresAt); err != nil {
+        return err
+    }
+
+    link := s.cfg.Server.PublicURL + "/verify-email?token=" + url.QueryEscape(token)
+    body := fmt.Sprintf(
+        "Подтвердите ваш email, перейдя по ссылке:\n\n%s\n\nСсылка действительна до %s.\n",
+        link,
+        expiresAt.UTC().Format(time.RFC1123),
+    )
+    return s.mailer.Send(user.Email, "Подтверждение email", body)
+}
+
+// VerifyEmail consumes a verification token and marks the owning account as verified.
+func (s *Service) VerifyEmail(token string) error {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    var userID string
+    var expiresAt time.Time
+    err = tx.QueryRowContext(
+        ctx,
+        `DELETE FROM email_verification_tokens WHERE token_hash = $1 RETURNING user_id, expires_at`,
+        hashVerificationToken(token),
+    ).Scan(&userID, &expiresAt)
+    if errors.Is(err, sql.ErrNoRows) {
+        return ErrInvalidVerificationToken
+    }
+    if err != nil {
+        return err
+    }
+    if time.Now().After(expiresAt) {
+        // Commit so the expired token is removed.
+        if err := tx.Commit(); err != nil {
+            return err
+        }
+        return ErrInvalidVerificationToken
+    }
+
+    query := `UPDATE users SET email_verified_at = COALESCE(email_verified_at, NOW()), updated_at = NOW() WHERE id = $1`
+    if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+        return err
+    }
+    if _, err := tx.ExecContext(ctx, `DELETE FROM email_verification_tokens WHERE user_id = $1`, userID); err != nil {
+        return err
+    }
+    return tx.Commit()
 }
 
 func (s *Service) getUserByEmail(email string) (*models.User, error) {
     ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
     defer cancel()
 
-    query := `SELECT id, email, password_hash FROM users WHERE email = $1`
+    query := `SELECT id, email, password_hash, user_type, email_verified_at, totp_enabled_at FROM users WHERE lower(email) = $1`
     row := s.db.QueryRowContext(ctx, query, email)
 
     var user models.User
-    if err := row.Scan(&user.ID, &user.Email, &user.PasswordHash); err != nil {
+    if err := row.Scan(&user.ID, &user.Email, &user.PasswordHash, &user.UserType, &user.EmailVerifiedAt, &user.TOTPEnabledAt); err != nil {
         return nil, err
     }
 
@@ -83,3 +283,16 @@ func checkPasswordHash(password, hash string) bool {
     err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
     return err == nil
 }
+
+func generateVerificationToken() (string, error) {
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashVerificationToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
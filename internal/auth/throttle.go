@@ -0,0 +1,78 @@
+package auth
+
+import (
+    "context"
+    "fmt"
+    "time"
+
+    "RealtimeChat/internal/config"
+    "RealtimeChat/internal/shared"
+)
+
+// LockedError is returned while a login key is locked out.
+type LockedError struct {
+    RetryAfter time.Duration
+}
+
+func (e *LockedError) Error() string {
+    return fmt.Sprintf("too many failed attempts, retry after %s", e.RetryAfter)
+}
+
+// loginThrottle keeps failed-attempt counters and lockouts in the shared
+// key-value store so that every instance sees the same state.
+type loginThrottle struct {
+    kv  shared.KeyValue
+    cfg config.LoginThrottle
+}
+
+func newLoginThrottle(kv shared.KeyValue, cfg config.LoginThrottle) *loginThrottle {
+    return &loginThrottle{kv: kv, cfg: cfg}
+}
+
+func emailThrottleKey(email string) string { return "login:email:" + email }
+func ipThrottleKey(ip string) string       { return "login:ip:" + ip }
+func mfaThrottleKey(userID string) string  { return "login:mfa:" + userID }
+
+// check returns the longest remaining lockout among keys, or zero.
+func (t *loginThrottle) check(ctx context.Context, keys ...string) (time.Duration, error) {
+    var retryAfter time.Duration
+    for _, key := range keys {
+        ttl, err := t.kv.TTL(ctx, key+":lock")
+        if err != nil {
+            return 0, err
+        }
+        if ttl > retryAfter {
+            retryAfter = ttl
+        }
+    }
+    return retryAfter, nil
+}
+
+// fail counts a failed attempt against key and locks it once max is reached.
+// The lockout doubles with each failure past the limit.
+func (t *loginThrottle) fail(ctx context.Context, key string, max int) (time.Duration, error) {
+    fails, err := t.kv.Incr(ctx, key+":fails", t.cfg.Window)
+    if err != nil {
+        return 0, err
+    }
+
+    over := fails - int64(max)
+    if over < 0 {
+        return 0, nil
+    }
+    lockout := t.cfg.BaseLockout
+    for i := int64(0); i < over && lockout < t.cfg.MaxLockout; i++ {
+        lockout *= 2
+    }
+    if lockout > t.cfg.MaxLockout {
+        lockout = t.cfg.MaxLockout
+    }
+    if err := t.kv.Set(ctx, key+":lock", "1", lockout); err != nil {
+        return 0, err
+    }
+    return lockout, nil
+}
+
+func (t *loginThrottle) reset(ctx context.Context, key string) error {
+    return t.kv.Del(ctx, key+":fails", key+":lock")
+}
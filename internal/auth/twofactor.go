@@ -0,0 +1,207 @@
+package auth
+
+import (
+    "context"
+    "crypto/rand"
+    "database/sql"
+    "encoding/base32"
+    "errors"
+    "log/slog"
+    "strings"
+    "time"
+
+    "RealtimeChat/internal/shared"
+)
+
+const recoveryCodeCount = 10
+
+var (
+    ErrTOTPAlreadyEnabled = errors.New("two-factor authentication already enabled")
+    ErrTOTPNotEnrolled    = errors.New("two-factor authentication not enrolled")
+    ErrInvalidTOTPCode    = errors.New("invalid two-factor code")
+)
+
+// swagger:model TOTPEnrollment
+type TOTPEnrollment struct {
+    Secret     string `json:"secret" example:"JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"`
+    OTPAuthURI string `json:"otpauth_uri" example:"otpauth://totp/RealtimeChat:user@example.com?secret=..."`
+}
+
+// EnrollTOTP generates a new secret for the user. 2FA stays disabled until
+// the secret is confirmed with ConfirmTOTP.
+func (s *Service) EnrollTOTP(userID string) (*TOTPEnrollment, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    var email string
+    var enabledAt *time.Time
+    err := s.db.QueryRowContext(ctx, `SELECT email, totp_enabled_at FROM users WHERE id = $1`, userID).Scan(&email, &enabledAt)
+    if err != nil {
+        return nil, err
+    }
+    if enabledAt != nil {
+        return nil, ErrTOTPAlreadyEnabled
+    }
+
+    secret, err := generateTOTPSecret()
+    if err != nil {
+        return nil, err
+    }
+    query := `UPDATE users SET totp_secret = $2, totp_last_counter = NULL, updated_at = NOW() WHERE id = $1`
+    if _, err := s.db.ExecContext(ctx, query, userID, secret); err != nil {
+        return nil, err
+    }
+
+    return &TOTPEnrollment{
+        Secret:     secret,
+        OTPAuthURI: otpauthURI(s.cfg.Auth.TOTPIssuer, email, secret),
+    }, nil
+}
+
+// ConfirmTOTP enables 2FA once the user proves their authenticator works and
+// returns a fresh set of recovery codes. Only their hashes are stored.
+func (s *Service) ConfirmTOTP(userID, code string) ([]string, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    var secret *string
+    var enabledAt *time.Time
+    err := s.db.QueryRowContext(ctx, `SELECT totp_secret, totp_enabled_at FROM users WHERE id = $1`, userID).Scan(&secret, &enabledAt)
+    if err != nil {
+        return nil, err
+    }
+    if enabledAt != nil {
+        return nil, ErrTOTPAlreadyEnabled
+    }
+    if secret == nil {
+        return nil, ErrTOTPNotEnrolled
+    }
+    counter, ok := validateTOTP(*secret, code, s.now())
+    if !ok {
+        return nil, ErrInvalidTOTPCode
+    }
+
+    codes := make([]string, recoveryCodeCount)
+    for i := range codes {
+        if codes[i], err = generateRecoveryCode(); err != nil {
+            return nil, err
+        }
+    }
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+
+    query := `UPDATE users SET totp_enabled_at = $2, totp_last_counter = $3, updated_at = NOW() WHERE id = $1`
+    if _, err := tx.ExecContext(ctx, query, userID, s.now(), counter); err != nil {
+        return nil, err
+    }
+    if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+        return nil, err
+    }
+    for _, c := range codes {
+        query := `INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`
+        if _, err := tx.ExecContext(ctx, query, userID, hashVerificationToken(normalizeRecoveryCode(c))); err != nil {
+            return nil, err
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, err
+    }
+    return codes, nil
+}
+
+// CompleteLogin finishes a two-step login started by Login. Exactly one of
+// code or recoveryCode is expected; a recovery code can be used only once.
+// Wrong codes are throttled per user and per ip like passwords.
+func (s *Service) CompleteLogin(mfaToken, code, recoveryCode, ip string) (string, error) {
+    userID, err := shared.ParseMFAToken(mfaToken)
+    if err != nil {
+        return "", ErrInvalidTOTPCode
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    mfaKey := mfaThrottleKey(userID)
+    retryAfter, err := s.throttle.check(ctx, mfaKey, ipThrottleKey(ip))
+    if err != nil {
+        slog.ErrorContext(ctx, "Login throttle check failed", "error", err)
+    }
+    if retryAfter > 0 {
+        s.recordFailedAttempt("", userID, ip, "locked")
+        return "", &LockedError{RetryAfter: retryAfter}
+    }
+
+    token, err := s.verifySecondFactor(ctx, userID, code, recoveryCode)
+    if errors.Is(err, ErrInvalidTOTPCode) {
+        s.loginFailed(ctx, mfaKey, "", userID, ip, "bad_2fa_code")
+        return "", err
+    }
+    if err != nil {
+        return "", err
+    }
+    if err := s.throttle.reset(ctx, mfaKey); err != nil {
+        slog.ErrorContext(ctx, "Login throttle reset failed", "error", err)
+    }
+    return token, nil
+}
+
+func (s *Service) verifySecondFactor(ctx context.Context, userID, code, recoveryCode string) (string, error) {
+    if recoveryCode != "" {
+        query := `UPDATE recovery_codes SET used_at = $3 WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`
+        res, err := s.db.ExecContext(ctx, query, userID, hashVerificationToken(normalizeRecoveryCode(recoveryCode)), s.now())
+        if err != nil {
+            return "", err
+        }
+        if n, _ := res.RowsAffected(); n != 1 {
+            return "", ErrInvalidTOTPCode
+        }
+        return shared.GenerateToken(userID)
+    }
+
+    var secret *string
+    err := s.db.QueryRowContext(
+        ctx,
+        `SELECT totp_secret FROM users WHERE id = $1 AND totp_enabled_at IS NOT NULL`,
+        userID,
+    ).Scan(&secret)
+    if errors.Is(err, sql.ErrNoRows) || (err == nil && secret == nil) {
+        return "", ErrInvalidTOTPCode
+    }
+    if err != nil {
+        return "", err
+    }
+    counter, ok := validateTOTP(*secret, code, s.now())
+    if !ok {
+        return "", ErrInvalidTOTPCode
+    }
+
+    // Moving the counter forward atomically rejects replays of a code that
+    // was already accepted within its validity window.
+    query := `UPDATE users SET totp_last_counter = $2 WHERE id = $1 AND (totp_last_counter IS NULL OR totp_last_counter < $2)`
+    res, err := s.db.ExecContext(ctx, query, userID, counter)
+    if err != nil {
+        return "", err
+    }
+    if n, _ := res.RowsAffected(); n != 1 {
+        return "", ErrInvalidTOTPCode
+    }
+    return shared.GenerateToken(userID)
+}
+
+func generateRecoveryCode() (string, error) {
+    b := make([]byte, 7)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))[:10]
+    return code[:5] + "-" + code[5:], nil
+}
+
+func normalizeRecoveryCode(code string) string {
+    code = strings.ToLower(strings.TrimSpace(code))
+    return strings.ReplaceAll(code, "-", "")
+}
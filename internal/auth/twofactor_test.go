@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"RealtimeChat/internal/shared"
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "auth-keys")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(filepath.Join(dir, "test.pem"), data, 0o600); err != nil {
+		panic(err)
+	}
+	if err := shared.LoadKeyDir(dir, ""); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// rfcSecret is the SHA1 seed of the RFC 6238 test vectors.
+var rfcSecret = []byte("12345678901234567890")
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// Appendix B of RFC 6238 lists 8-digit codes; authenticators show the
+	// last 6 digits.
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		counter := totpCounter(time.Unix(tt.unix, 0))
+		if got := totpCode(rfcSecret, counter); got != tt.code {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestValidateTOTPSkew(t *testing.T) {
+	secret := totpEncoding.EncodeToString(rfcSecret)
+	now := time.Unix(1234567890, 0)
+	current := totpCounter(now)
+
+	for step := int64(-3); step <= 3; step++ {
+		code := totpCode(rfcSecret, current+step)
+		counter, ok := validateTOTP(secret, code, now)
+		want := step >= -totpSkew && step <= totpSkew
+		if ok != want {
+			t.Errorf("step %+d: accepted = %v, want %v", step, ok, want)
+		}
+		if ok && counter != current+step {
+			t.Errorf("step %+d: matched counter %d, want %d", step, counter, current+step)
+		}
+	}
+
+	if _, ok := validateTOTP(secret, "12345", now); ok {
+		t.Error("short code accepted")
+	}
+}
+
+func newTestService(t *testing.T, now time.Time) (*Service, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &Service{db: &shared.DB{DB: db}, now: func() time.Time { return now }}, mock
+}
+
+func TestVerifySecondFactorRejectsReplay(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	s, mock := newTestService(t, now)
+	secret := totpEncoding.EncodeToString(rfcSecret)
+	counter := totpCounter(now)
+	code := totpCode(rfcSecret, counter)
+
+	selectSecret := regexp.QuoteMeta(`SELECT totp_secret FROM users`)
+	advance := regexp.QuoteMeta(`UPDATE users SET totp_last_counter = $2`)
+
+	// First use moves the stored counter to the matched step.
+	mock.ExpectQuery(selectSecret).WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"totp_secret"}).AddRow(secret))
+	mock.ExpectExec(advance).WithArgs("user-1", counter).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// The same step again no longer moves it forward.
+	mock.ExpectQuery(selectSecret).WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"totp_secret"}).AddRow(secret))
+	mock.ExpectExec(advance).WithArgs("user-1", counter).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	ctx := t.Context()
+	if token, err := s.verifySecondFactor(ctx, "user-1", code, ""); err != nil || token == "" {
+		t.Fatalf("first use: token %q, err %v", token, err)
+	}
+	if _, err := s.verifySecondFactor(ctx, "user-1", code, ""); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Fatalf("replay: err = %v, want ErrInvalidTOTPCode", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifySecondFactorWrongCode(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	s, mock := newTestService(t, now)
+	secret := totpEncoding.EncodeToString(rfcSecret)
+	stale := totpCode(rfcSecret, totpCounter(now)-2)
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT totp_secret FROM users`)).WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"totp_secret"}).AddRow(secret))
+
+	if _, err := s.verifySecondFactor(t.Context(), "user-1", stale, ""); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Fatalf("err = %v, want ErrInvalidTOTPCode", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRecoveryCodeSingleUse(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	s, mock := newTestService(t, now)
+	hash := hashVerificationToken("abcde12345")
+	useCode := regexp.QuoteMeta(`UPDATE recovery_codes SET used_at = $3 WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`)
+
+	mock.ExpectExec(useCode).WithArgs("user-1", hash, now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(useCode).WithArgs("user-1", hash, now).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	ctx := t.Context()
+	// Codes are accepted regardless of case, dashes and surrounding space.
+	if token, err := s.verifySecondFactor(ctx, "user-1", "", " ABCDE-12345 "); err != nil || token == "" {
+		t.Fatalf("first use: token %q, err %v", token, err)
+	}
+	if _, err := s.verifySecondFactor(ctx, "user-1", "", "abcde-12345"); !errors.Is(err, ErrInvalidTOTPCode) {
+		t.Fatalf("second use: err = %v, want ErrInvalidTOTPCode", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,125 @@
+package auth
+
+import (
+    "errors"
+    "fmt"
+    "reflect"
+    "strconv"
+    "strings"
+    "unicode"
+
+    "RealtimeChat/internal/config"
+    "github.com/go-playground/validator/v10"
+)
+
+// swagger:model FieldError
+type FieldError struct {
+    Field   string `json:"field" example:"email"`
+    Message string `json:"message" example:"must be a valid email address"`
+}
+
+// swagger:model ValidationErrorResponse
+type ValidationErrorResponse struct {
+    Error  string       `json:"error" example:"validation failed"`
+    Fields []FieldError `json:"fields"`
+}
+
+type requestValidator struct {
+    validate *validator.Validate
+    policy   config.PasswordPolicy
+}
+
+func newRequestValidator(policy config.PasswordPolicy) *requestValidator {
+    v := validator.New(validator.WithRequiredStructEnabled())
+    v.RegisterTagNameFunc(func(f reflect.StructField) string {
+        name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+        if name == "-" {
+            return ""
+        }
+        return name
+    })
+    rv := &requestValidator{validate: v, policy: policy}
+    // bcrypt rejects passwords over 72 bytes, and "max" counts characters.
+    v.RegisterValidation("maxbytes", func(fl validator.FieldLevel) bool {
+        n, err := strconv.Atoi(fl.Param())
+        return err == nil && len(fl.Field().String()) <= n
+    })
+    v.RegisterValidation("password", func(fl validator.FieldLevel) bool {
+        return len(rv.passwordProblems(fl.Field().String())) == 0
+    })
+    return rv
+}
+
+// Struct validates s and converts validator errors into field-level messages.
+func (rv *requestValidator) Struct(s interface{}) []FieldError {
+    err := rv.validate.Struct(s)
+    if err == nil {
+        return nil
+    }
+    var verrs validator.ValidationErrors
+    if !errors.As(err, &verrs) {
+        return []FieldError{{Message: err.Error()}}
+    }
+    fields := make([]FieldError, 0, len(verrs))
+    for _, fe := range verrs {
+        fields = append(fields, FieldError{Field: fe.Field(), Message: rv.message(fe)})
+    }
+    return fields
+}
+
+func (rv *requestValidator) message(fe validator.FieldError) string {
+    switch fe.Tag() {
+    case "required":
+        return "is required"
+    case "email":
+        return "must be a valid email address"
+    case "min":
+        return fmt.Sprintf("must be at least %s characters long", fe.Param())
+    case "max":
+        return fmt.Sprintf("must be at most %s characters long", fe.Param())
+    case "maxbytes":
+        return fmt.Sprintf("must be at most %s bytes long", fe.Param())
+    case "password":
+        return "must " + strings.Join(rv.passwordProblems(fe.Value().(string)), ", ")
+    default:
+        return "is invalid"
+    }
+}
+
+func (rv *requestValidator) passwordProblems(password string) []string {
+    var hasUpper, hasLower, hasDigit, hasSymbol bool
+    for _, r := range password {
+        switch {
+        case unicode.IsUpper(r):
+            hasUpper = true
+        case unicode.IsLower(r):
+            hasLower = true
+        case unicode.IsDigit(r):
+            hasDigit = true
+        case unicode.IsPunct(r) || unicode.IsSymbol(r):
+            hasSymbol = true
+        }
+    }
+
+    var problems []string
+    if len([]rune(password)) < rv.policy.MinLength {
+        problems = append(problems, fmt.Sprintf("be at least %d characters long", rv.policy.MinLength))
+    }
+    if rv.policy.RequireUpper && !hasUpper {
+        problems = append(problems, "contain an uppercase letter")
+    }
+    if rv.policy.RequireLower && !hasLower {
+        problems = append(problems, "contain a lowercase letter")
+    }
+    if rv.policy.RequireDigit && !hasDigit {
+        problems = append(problems, "contain a digit")
+    }
+    if rv.policy.RequireSymbol && !hasSymbol {
+        problems = append(problems, "contain a symbol")
+    }
+    return problems
+}
+
+func normalizeEmail(email string) string {
+    return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,80 @@
+package chat
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"RealtimeChat/internal/metrics"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// clientSendBuffer is how many events may wait for a slow client before
+	// its connection is dropped.
+	clientSendBuffer = 64
+	// writeWait bounds a single write to a client.
+	writeWait = 10 * time.Second
+)
+
+// client is one WebSocket connection. A websocket.Conn allows only one
+// writer at a time, so every message goes through send and is written by
+// the writer goroutine alone; only control frames are written directly.
+type client struct {
+	conn   *websocket.Conn
+	userID string
+	send   chan interface{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+// newClient starts the writer of conn. stop must be called once the
+// connection is closed.
+func newClient(conn *websocket.Conn, userID string) *client {
+	c := &client{
+		conn:   conn,
+		userID: userID,
+		send:   make(chan interface{}, clientSendBuffer),
+		done:   make(chan struct{}),
+	}
+	go c.writer()
+	return c
+}
+
+// write queues msg for the client without blocking. A client that falls
+// clientSendBuffer messages behind is disconnected.
+func (c *client) write(msg interface{}) {
+	select {
+	case <-c.done:
+	case c.send <- msg:
+	default:
+		metrics.WebSocketWriteFailures.Inc()
+		slog.Warn("WebSocket: client too slow, closing connection", "user_id", c.userID)
+		// Further writes are dropped silently until the read loop cleans up.
+		c.stop()
+		c.conn.Close()
+	}
+}
+
+func (c *client) writer() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				metrics.WebSocketWriteFailures.Inc()
+				slog.Warn("WebSocket: write failed", "user_id", c.userID, "error", err)
+				// Ends the read loop, which cleans up.
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// stop ends the writer; queued messages are dropped.
+func (c *client) stop() {
+	c.once.Do(func() { close(c.done) })
+}
@@ -0,0 +1,113 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"RealtimeChat/internal/metrics"
+	"RealtimeChat/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// MessageChannel carries new messages to every instance, each of which
+// delivers them to its own WebSocket clients.
+const MessageChannel = "chat:messages"
+
+// fanoutEvent is a message on MessageChannel. UserIDs is set for direct
+// messages; broadcasts go to everybody who does not hide SenderID.
+type fanoutEvent struct {
+	Kind     string          `json:"kind"`
+	SenderID string          `json:"sender_id,omitempty"`
+	UserIDs  []string        `json:"user_ids,omitempty"`
+	Message  json.RawMessage `json:"message"`
+}
+
+// sendBroadcast delivers a public message to every connected client except
+// those who blocked or muted the sender.
+func (h *Handler) sendBroadcast(ctx context.Context, senderID string, msg map[string]interface{}) {
+	ctx, span := tracing.Start(ctx, "chat.fanout", attribute.String("fanout.kind", metrics.FanoutBroadcast))
+	defer span.End()
+	h.publish(ctx, fanoutEvent{Kind: metrics.FanoutBroadcast, SenderID: senderID}, msg)
+}
+
+func (h *Handler) sendToUsers(ctx context.Context, userIDs []string, msg map[string]interface{}) {
+	ctx, span := tracing.Start(ctx, "chat.fanout",
+		attribute.String("fanout.kind", metrics.FanoutDirect),
+		attribute.Int("fanout.recipients", len(userIDs)),
+	)
+	defer span.End()
+	h.publish(ctx, fanoutEvent{Kind: metrics.FanoutDirect, UserIDs: userIDs}, msg)
+}
+
+// publish sends event with msg to every instance. When that fails the
+// clients connected here still get it.
+func (h *Handler) publish(ctx context.Context, event fanoutEvent, msg map[string]interface{}) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		slog.ErrorContext(ctx, "Fan-out: failed to encode message", "error", err)
+		return
+	}
+	event.Message = data
+	payload, err := json.Marshal(event)
+	if err != nil {
+		slog.ErrorContext(ctx, "Fan-out: failed to encode event", "error", err)
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	if err := h.pubsub.Publish(ctx, MessageChannel, string(payload)); err != nil {
+		slog.ErrorContext(ctx, "Fan-out: failed to publish message, delivering locally only", "error", err)
+		h.deliver(ctx, event)
+	}
+}
+
+// WatchMessages delivers the messages published by any instance to the
+// local clients until ctx is cancelled.
+func (h *Handler) WatchMessages(ctx context.Context) {
+	h.pubsub.Subscribe(ctx, MessageChannel, func(ctx context.Context, payload string) {
+		var event fanoutEvent
+		if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			slog.ErrorContext(ctx, "Fan-out: invalid event", "error", err)
+			return
+		}
+		h.deliver(ctx, event)
+	})
+}
+
+// deliver writes event to the recipients connected here. ctx carries the
+// trace of the sender, so delivery shows up in the same trace.
+func (h *Handler) deliver(ctx context.Context, event fanoutEvent) {
+	ctx, span := tracing.Start(ctx, "chat.deliver", attribute.String("fanout.kind", event.Kind))
+	defer span.End()
+	start := time.Now()
+	defer func() {
+		metrics.FanoutDuration.WithLabelValues(event.Kind).Observe(time.Since(start).Seconds())
+	}()
+
+	switch event.Kind {
+	case metrics.FanoutBroadcast:
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		hidden, err := h.service.HiddenFrom(ctx, event.SenderID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Broadcast: failed to load blocks", "sender_id", event.SenderID, "error", err)
+		}
+		start = time.Now()
+		h.clientsMu.RLock()
+		defer h.clientsMu.RUnlock()
+		for userID, session := range h.clients {
+			if !hidden[userID] {
+				session.client.write(event.Message)
+			}
+		}
+	case metrics.FanoutDirect:
+		h.clientsMu.RLock()
+		defer h.clientsMu.RUnlock()
+		for _, userID := range event.UserIDs {
+			if session, ok := h.clients[userID]; ok && session != nil {
+				session.client.write(event.Message)
+			}
+		}
+	}
+}
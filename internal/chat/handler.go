@@ -1,73 +1,167 @@
 package chat
 
 import (
+    "RealtimeChat/internal/cors"
+    "RealtimeChat/internal/metrics"
+    "RealtimeChat/internal/presence"
+    "RealtimeChat/internal/ratelimit"
     "RealtimeChat/internal/shared"
+    "RealtimeChat/internal/tracing"
+    "context"
+    "database/sql"
     "encoding/json"
+    "errors"
     "fmt"
-    "io"
-    "log"
+    "log/slog"
     "net/http"
-    "os"
     "sync"
+    "sync/atomic"
     "time"
 
     "github.com/golang-jwt/jwt/v5"
     "github.com/google/uuid"
     "github.com/gorilla/websocket"
+    "go.opentelemetry.io/otel/attribute"
 )
 
 
 type Handler struct {
     service   *Service
-    clients   map[string]*websocket.Conn
+    presence  *presence.Service
+    pubsub    shared.PubSub
+    limiter   *ratelimit.Limiter
+    upgrader  websocket.Upgrader
+    clients   map[string]*wsSession
     clientsMu sync.RWMutex
+    // conns tracks the WebSocket handlers still running; once draining is
+    // set no connection is added anymore.
+    conns    sync.WaitGroup
+    draining atomic.Bool
+
+    presenceMu sync.Mutex
+    // subscriptions maps a connected user to the users whose presence they
+    // subscribed to; subscribers is the reverse index.
+    subscriptions map[string]map[string]bool
+    subscribers   map[string]map[string]bool
+    // lastPresence is what each connected user was last told about others.
+    lastPresence map[string]map[string]string
 }
 
-func NewHandler(service *Service) *Handler {
+func NewHandler(service *Service, presence *presence.Service, pubsub shared.PubSub, limiter *ratelimit.Limiter, origins *cors.Policy) *Handler {
     return &Handler{
-        service: service,
-        clients: make(map[string]*websocket.Conn),
+        service:       service,
+        presence:      presence,
+        pubsub:        pubsub,
+        limiter:       limiter,
+        upgrader:      websocket.Upgrader{CheckOrigin: origins.CheckOrigin},
+        clients:       make(map[string]*wsSession),
+        subscriptions: make(map[string]map[string]bool),
+        subscribers:   make(map[string]map[string]bool),
+        lastPresence:  make(map[string]map[string]string),
     }
 }
 
-func (h *Handler) addClient(userID string, conn *websocket.Conn) {
+// addClient registers session as the connection of its user and reports
+// false when the server is shutting down. Every registered connection must
+// call h.conns.Done when its handler returns.
+func (h *Handler) addClient(session *wsSession) bool {
     h.clientsMu.Lock()
     defer h.clientsMu.Unlock()
-    if old, exists := h.clients[userID]; exists && old != nil {
-        log.Printf("Closing previous WS connection for user %s", userID)
-        old.Close()
+    if h.draining.Load() {
+        return false
+    }
+    if old, exists := h.clients[session.userID]; exists && old != nil {
+        slog.Info("Closing previous WS connection", "user_id", session.userID)
+        old.client.conn.Close()
     }
-    h.clients[userID] = conn
+    h.clients[session.userID] = session
+    h.conns.Add(1)
+    return true
 }
 
-func (h *Handler) removeClient(userID string) {
+// removeClient forgets session and reports whether it was still the current
+// connection of its user, i.e. not replaced by a newer one.
+func (h *Handler) removeClient(session *wsSession) bool {
     h.clientsMu.Lock()
     defer h.clientsMu.Unlock()
-    if _, exists := h.clients[userID]; exists {
-        delete(h.clients, userID)
+    if current, exists := h.clients[session.userID]; exists && current == session {
+        delete(h.clients, session.userID)
+        return true
     }
+    return false
 }
 
-func (h *Handler) sendBroadcast(msg map[string]interface{}) {
-    h.clientsMu.RLock()
-    defer h.clientsMu.RUnlock()
-    for userID, conn := range h.clients {
-        if err := conn.WriteJSON(msg); err != nil {
-            log.Printf("Broadcast: failed for %s: %v", userID, err)
+// goingAway is the close frame that tells clients to reconnect, possibly to
+// another instance.
+var goingAway = websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+
+// Shutdown asks every WebSocket client to reconnect elsewhere and waits
+// until their handlers have returned, so messages being saved are not cut
+// off. Connections still open when ctx is done are closed forcibly.
+func (h *Handler) Shutdown(ctx context.Context) {
+    h.clientsMu.Lock()
+    h.draining.Store(true)
+    conns := make([]*websocket.Conn, 0, len(h.clients))
+    for _, session := range h.clients {
+        conns = append(conns, session.client.conn)
+    }
+    h.clientsMu.Unlock()
+
+    for _, conn := range conns {
+        // WriteControl may be called concurrently with the other writers.
+        if err := conn.WriteControl(websocket.CloseMessage, goingAway, time.Now().Add(time.Second)); err != nil {
+            conn.Close()
         }
     }
+
+    done := make(chan struct{})
+    go func() {
+        h.conns.Wait()
+        close(done)
+    }()
+    select {
+    case <-done:
+        return
+    case <-ctx.Done():
+    }
+    slog.Warn("WebSocket: closing connections that did not go away in time", "connections", len(conns))
+    for _, conn := range conns {
+        conn.Close()
+    }
+    <-done
 }
 
-func (h *Handler) sendToUsers(userIDs []string, msg map[string]interface{}) {
+// WatchRevocations closes the connections of users whose tokens are revoked
+// until ctx is cancelled.
+func (h *Handler) WatchRevocations(ctx context.Context) {
+    shared.WatchRevocations(ctx, h.closeUser)
+}
+
+// closeUser closes the connection of userID, if it is connected here. With
+// a tokenID only a connection authenticated by that API token is closed.
+func (h *Handler) closeUser(ctx context.Context, userID, tokenID string) {
+    h.clientsMu.RLock()
+    session, ok := h.clients[userID]
+    h.clientsMu.RUnlock()
+    if !ok {
+        return
+    }
+    slog.InfoContext(ctx, "Closing WS connection of revoked token", "user_id", userID, "token_id", tokenID)
+    session.revoke(tokenID)
+}
+
+// ConnectionCount returns the number of connected WebSocket clients.
+func (h *Handler) ConnectionCount() int {
     h.clientsMu.RLock()
     defer h.clientsMu.RUnlock()
-    for _, userID := range userIDs {
-        if conn, ok := h.clients[userID]; ok && conn != nil {
-            if err := conn.WriteJSON(msg); err != nil {
-                log.Printf("PrivateWS: failed for %s: %v", userID, err)
-            }
-        }
+    return len(h.clients)
+}
+
+func messageType(recipientUserID *string) string {
+    if recipientUserID == nil {
+        return metrics.MessagePublic
     }
+    return metrics.MessagePrivate
 }
 
 // @Summary Отправить сообщение (публичное или личное)
@@ -79,6 +173,9 @@ func (h *Handler) sendToUsers(userIDs []string, msg map[string]interface{}) {
 // @Success 201
 // @Failure 400 {string} string "Invalid request"
 // @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Email not verified or recipient blocked"
+// @Failure 429 {string} string "Too many requests"
+// @Header 429 {integer} Retry-After "Seconds until the rate limit allows another request"
 // @Router /messages [post]
 func (h *Handler) PostMessage(w http.ResponseWriter, r *http.Request) {
     if r.Method != http.MethodPost {
@@ -95,8 +192,17 @@ func (h *Handler) PostMessage(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "Unauthorized", http.StatusUnauthorized)
         return
     }
-    if err := shared.SetUserOnline(userID); err != nil {
-        log.Printf("Failed to set user online: %v", err)
+    if err := shared.SetUserOnline(r.Context(), userID); err != nil {
+        slog.ErrorContext(r.Context(), "Failed to set user online", "error", err)
+    }
+    if err := h.service.CanSendMessages(r.Context(), userID); err != nil {
+        if errors.Is(err, ErrEmailNotVerified) {
+            http.Error(w, "Email not verified", http.StatusForbidden)
+            return
+        }
+        slog.ErrorContext(r.Context(), "Failed to check sender", "error", err)
+        http.Error(w, "Failed to save message", http.StatusInternalServerError)
+        return
     }
 
     var req struct {
@@ -110,35 +216,41 @@ func (h *Handler) PostMessage(w http.ResponseWriter, r *http.Request) {
 
     var recipientUserID *string
     if req.Recipient != nil && *req.Recipient != "" {
-        var id string
-        err := h.service.db.QueryRowContext(
-            r.Context(),
-            `SELECT id FROM users WHERE email = $1`,
-            *req.Recipient,
-        ).Scan(&id)
+        id, err := h.service.UserIDByEmail(r.Context(), *req.Recipient)
         if err != nil {
             http.Error(w, "Recipient user not found", http.StatusBadRequest)
             return
         }
+        if err := h.service.CheckCanMessage(r.Context(), userID, id); err != nil {
+            if errors.Is(err, ErrBlocked) {
+                http.Error(w, err.Error(), http.StatusForbidden)
+                return
+            }
+            slog.ErrorContext(r.Context(), "Failed to check blocks", "error", err)
+            http.Error(w, "Failed to save message", http.StatusInternalServerError)
+            return
+        }
         recipientUserID = &id
     }
 
-    if err := h.service.SaveMessage(userID, recipientUserID, req.Content); err != nil {
-        log.Printf("Failed to save message: %v", err)
+    if err := h.service.SaveMessage(r.Context(), userID, recipientUserID, req.Content); err != nil {
+        slog.ErrorContext(r.Context(), "Failed to save message", "error", err)
         http.Error(w, "Failed to save message", http.StatusInternalServerError)
         return
     }
+    metrics.MessagesSent.WithLabelValues(messageType(recipientUserID)).Inc()
 
     msgPayload := map[string]interface{}{
         "user_id":           userID,
+        "sender":            h.service.GetUserSummary(r.Context(), userID),
         "recipient_user_id": recipientUserID,
         "content":           req.Content,
         "created_at":        time.Now(),
     }
     if recipientUserID == nil {
-        h.sendBroadcast(msgPayload)
+        h.sendBroadcast(r.Context(), userID, msgPayload)
     } else {
-        h.sendToUsers([]string{userID, *recipientUserID}, msgPayload)
+        h.sendToUsers(r.Context(), []string{userID, *recipientUserID}, msgPayload)
     }
     w.WriteHeader(http.StatusCreated)
 }
@@ -159,14 +271,15 @@ func (h *Handler) GetMessages(w http.ResponseWriter, r *http.Request) {
     if ok {
         userID := fmt.Sprintf("%v", claims["user_id"])
         if userID != "" && userID != "<nil>" {
-            if err := shared.SetUserOnline(userID); err != nil {
-                log.Printf("Failed to set user online: %v", err)
+            if err := shared.SetUserOnline(r.Context(), userID); err != nil {
+                slog.ErrorContext(r.Context(), "Failed to set user online", "error", err)
             }
         }
     }
-    messages, err := h.service.GetGeneralMessages(50)
+    viewerID := fmt.Sprintf("%v", claims["user_id"])
+    messages, err := h.service.GetGeneralMessages(viewerID, 50)
     if err != nil {
-        log.Printf("Failed to fetch messages: %v", err)
+        slog.ErrorContext(r.Context(), "Failed to fetch messages", "error", err)
         http.Error(w, "Failed to fetch messages", http.StatusInternalServerError)
         return
     }
@@ -175,7 +288,7 @@ func (h *Handler) GetMessages(w http.ResponseWriter, r *http.Request) {
 }
 
 // @Summary Получить переписку с пользователем
-// @Description Возвращает историю переписки с пользователем по email. В ответе — онлайн статус собеседника
+// @Description Возвращает историю переписки с пользователем по email. В ответе — онлайн статус и присутствие собеседника
 // @Tags message
 // @Produce json
 // @Param email path string true "Email собеседника"
@@ -198,30 +311,25 @@ func (h *Handler) GetConversationMessages(w http.ResponseWriter, r *http.Request
         http.Error(w, "Unauthorized", http.StatusUnauthorized)
         return
     }
-    if err := shared.SetUserOnline(currentUserID); err != nil {
-        log.Printf("Failed to set user online: %v", err)
+    if err := shared.SetUserOnline(r.Context(), currentUserID); err != nil {
+        slog.ErrorContext(r.Context(), "Failed to set user online", "error", err)
     }
 
-    var otherUserID string
-    err := h.service.db.QueryRowContext(
-        r.Context(),
-        `SELECT id FROM users WHERE email = $1`,
-        otherEmail,
-    ).Scan(&otherUserID)
+    otherUserID, err := h.service.UserIDByEmail(r.Context(), otherEmail)
     if err != nil {
         http.Error(w, "User not found", http.StatusBadRequest)
         return
     }
 
-    isOnline, err := shared.IsUserOnline(otherUserID)
+    otherPresence, err := h.presence.Get(r.Context(), currentUserID, otherUserID)
     if err != nil {
-        log.Printf("Failed to check online status: %v", err)
-        isOnline = false
+        slog.ErrorContext(r.Context(), "Failed to check online status", "error", err)
+        otherPresence = &presence.Presence{UserID: otherUserID, State: presence.StateOffline}
     }
 
     messages, err := h.service.GetConversationMessages(currentUserID, otherEmail, 50)
     if err != nil {
-        log.Printf("Failed to fetch conversation: %v", err)
+        slog.ErrorContext(r.Context(), "Failed to fetch conversation", "error", err)
         http.Error(w, "Failed to fetch conversation: "+err.Error(), http.StatusInternalServerError)
         return
     }
@@ -231,7 +339,8 @@ func (h *Handler) GetConversationMessages(w http.ResponseWriter, r *http.Request
         "other_user": map[string]interface{}{
             "id":        otherUserID,
             "email":     otherEmail,
-            "is_online": isOnline,
+            "is_online": otherPresence.Online(),
+            "presence":  otherPresence,
         },
     })
 }
@@ -247,6 +356,9 @@ func (h *Handler) GetConversationMessages(w http.ResponseWriter, r *http.Request
 // @Success 201 {object} map[string]string
 // @Failure 400 {string} string "Bad request"
 // @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Email not verified or recipient blocked"
+// @Failure 429 {string} string "Too many requests"
+// @Header 429 {integer} Retry-After "Seconds until the rate limit allows another request"
 // @Router /messages/attachment [post]
 func (h *Handler) PostMessageWithAttachment(w http.ResponseWriter, r *http.Request) {
     if r.Method != http.MethodPost {
@@ -263,8 +375,17 @@ func (h *Handler) PostMessageWithAttachment(w http.ResponseWriter, r *http.Reque
         http.Error(w, "Unauthorized", http.StatusUnauthorized)
         return
     }
-    if err := shared.SetUserOnline(userID); err != nil {
-        log.Printf("Failed to set user online: %v", err)
+    if err := shared.SetUserOnline(r.Context(), userID); err != nil {
+        slog.ErrorContext(r.Context(), "Failed to set user online", "error", err)
+    }
+    if err := h.service.CanSendMessages(r.Context(), userID); err != nil {
+        if errors.Is(err, ErrEmailNotVerified) {
+            http.Error(w, "Email not verified", http.StatusForbidden)
+            return
+        }
+        slog.ErrorContext(r.Context(), "Failed to check sender", "error", err)
+        http.Error(w, "Failed to save message", http.StatusInternalServerError)
+        return
     }
 
     err := r.ParseMultipartForm(10 << 20)
@@ -278,16 +399,20 @@ func (h *Handler) PostMessageWithAttachment(w http.ResponseWriter, r *http.Reque
     var recipientUserID *string
     recipient := r.FormValue("recipient")
     if recipient != "" {
-        var id string
-        err := h.service.db.QueryRowContext(
-            r.Context(),
-            `SELECT id FROM users WHERE email = $1`,
-            recipient,
-        ).Scan(&id)
+        id, err := h.service.UserIDByEmail(r.Context(), recipient)
         if err != nil {
             http.Error(w, "Recipient user not found", http.StatusBadRequest)
             return
         }
+        if err := h.service.CheckCanMessage(r.Context(), userID, id); err != nil {
+            if errors.Is(err, ErrBlocked) {
+                http.Error(w, err.Error(), http.StatusForbidden)
+                return
+            }
+            slog.ErrorContext(r.Context(), "Failed to check blocks", "error", err)
+            http.Error(w, "Failed to save message", http.StatusInternalServerError)
+            return
+        }
         recipientUserID = &id
     }
 
@@ -298,34 +423,29 @@ func (h *Handler) PostMessageWithAttachment(w http.ResponseWriter, r *http.Reque
     }
     defer file.Close()
 
-    filePath := fmt.Sprintf("storage/%d_%s", time.Now().UnixNano(), handler.Filename)
-    out, err := os.Create(filePath)
+    filePath, err := h.service.storage.Save(handler.Filename, file)
     if err != nil {
-        log.Printf("Failed to save file: %v", err)
-        http.Error(w, "Could not save file", http.StatusInternalServerError)
-        return
-    }
-    defer out.Close()
-    if _, err = io.Copy(out, file); err != nil {
-        log.Printf("Failed to save file: %v", err)
+        slog.ErrorContext(r.Context(), "Failed to save file", "error", err)
         http.Error(w, "Could not save file", http.StatusInternalServerError)
         return
     }
 
     messageID := uuid.NewString()
-    if err := h.service.SaveMessageWithID(messageID, userID, recipientUserID, content); err != nil {
-        log.Printf("Failed to save message: %v", err)
+    if err := h.service.SaveMessageWithID(r.Context(), messageID, userID, recipientUserID, content); err != nil {
+        slog.ErrorContext(r.Context(), "Failed to save message", "error", err)
         http.Error(w, "Failed to save message", http.StatusInternalServerError)
         return
     }
     if err := h.service.SaveAttachment(messageID, userID, filePath, handler.Filename, handler.Header.Get("Content-Type")); err != nil {
-        log.Printf("Failed to save attachment: %v", err)
+        slog.ErrorContext(r.Context(), "Failed to save attachment", "error", err)
         http.Error(w, "Failed to save attachment", http.StatusInternalServerError)
         return
     }
+    metrics.MessagesSent.WithLabelValues(metrics.MessageAttachment).Inc()
 
     msgPayload := map[string]interface{}{
         "user_id":           userID,
+        "sender":            h.service.GetUserSummary(r.Context(), userID),
         "recipient_user_id": recipientUserID,
         "attachment": map[string]string{
             "file_name": handler.Filename,
@@ -336,24 +456,73 @@ func (h *Handler) PostMessageWithAttachment(w http.ResponseWriter, r *http.Reque
         "created_at": time.Now(),
     }
     if recipientUserID == nil {
-        h.sendBroadcast(msgPayload)
+        h.sendBroadcast(r.Context(), userID, msgPayload)
     } else {
-        h.sendToUsers([]string{userID, *recipientUserID}, msgPayload)
+        h.sendToUsers(r.Context(), []string{userID, *recipientUserID}, msgPayload)
     }
     w.WriteHeader(http.StatusCreated)
     json.NewEncoder(w).Encode(map[string]string{"message_id": messageID})
 }
 
-var upgrader = websocket.Upgrader{
-    CheckOrigin: func(r *http.Request) bool { return true },
+// presenceHeartbeat is how often an open connection refreshes the 60 second
+// online key.
+const presenceHeartbeat = 30 * time.Second
+
+// WSTicketResponse is returned by POST /ws/ticket.
+type WSTicketResponse struct {
+    Ticket string `json:"ticket"`
+    // ExpiresIn is how many seconds the ticket may be redeemed.
+    ExpiresIn int `json:"expires_in"`
+}
+
+// @Summary Билет для подключения к WebSocket
+// @Description Браузер не может передать заголовок Authorization при подключении к WebSocket.
+// @Description Билет одноразовый, действует 30 секунд и передаётся как /ws?ticket=...;
+// @Description соединение получает права и срок действия токена, для которого выдан билет.
+// @Tags websocket
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} WSTicketResponse
+// @Failure 401 {string} string "Unauthorized"
+// @Router /ws/ticket [post]
+func (h *Handler) WebSocketTicket(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    claims, ok := r.Context().Value("userClaims").(jwt.MapClaims)
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+    ticket, err := shared.IssueWSTicket(r.Context(), claims)
+    if err != nil {
+        slog.ErrorContext(r.Context(), "Failed to issue WebSocket ticket", "error", err)
+        http.Error(w, "Failed to issue ticket", http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-store")
+    json.NewEncoder(w).Encode(WSTicketResponse{Ticket: ticket, ExpiresIn: int(shared.WSTicketTTL.Seconds())})
 }
 
 // @Summary WebSocket чат
-// @Description Подключение к real-time чату с JWT
+// @Description Подключение к real-time чату с JWT в заголовке Authorization или с билетом из POST /ws/ticket
+// @Description в параметре ticket. Клиент отправляет сообщения {"content", "recipient"}
+// @Description и может подписаться на присутствие пользователей: {"type": "presence.subscribe", "user_ids": [...]}
+// @Description (или presence.unsubscribe). Сервер присылает {"type": "presence.changed", "presence": {...}}
+// @Description при подключении, отключении или смене состояния собеседников по личным чатам и подписок.
+// @Description Сверх лимита сообщений сервер отвечает {"error": "rate limit exceeded", "retry_after": секунды}.
+// @Description Когда токен истекает, соединение закрывается с кодом 4001; продлить его можно,
+// @Description отправив {"type": "auth", "token": "..."} с новым токеном того же пользователя.
+// @Description При отзыве токенов пользователя (например, после удаления аккаунта) или API-токена, которым
+// @Description открыто соединение, оно закрывается с кодом 4003. После кода 4001 или 4003 токен продлить уже нельзя.
 // @Tags websocket
-// @Param Authorization header string true "Bearer JWT"
+// @Param Authorization header string false "Bearer JWT"
+// @Param ticket query string false "Билет из POST /ws/ticket"
 // @Success 101 "Switching Protocols"
 // @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Origin not allowed"
 // @Router /ws [get]
 func (h *Handler) WebSocket(w http.ResponseWriter, r *http.Request) {
     claims, ok := r.Context().Value("userClaims").(jwt.MapClaims)
@@ -366,56 +535,166 @@ func (h *Handler) WebSocket(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "Unauthorized", http.StatusUnauthorized)
         return
     }
-    _ = shared.SetUserOnline(userID)
+    _ = shared.SetUserOnline(r.Context(), userID)
+    ip := shared.ClientIP(r)
 
-    conn, err := upgrader.Upgrade(w, r, nil)
+    // Upgrade has already replied when it fails, with 403 for a foreign
+    // origin.
+    conn, err := h.upgrader.Upgrade(w, r, nil)
     if err != nil {
-        http.Error(w, "Failed to upgrade connection", http.StatusInternalServerError)
         return
     }
-    h.addClient(userID, conn)
+    c := newClient(conn, userID)
+    session := newWSSession(c, ip, claims)
+    if !h.addClient(session) {
+        session.close()
+        c.stop()
+        conn.WriteControl(websocket.CloseMessage, goingAway, time.Now().Add(time.Second))
+        conn.Close()
+        return
+    }
+    defer h.conns.Done()
+    h.forgetPresence(userID)
+    h.seedPresence(r.Context(), userID)
+    // Keep the heartbeat alive while the connection is open, even if the
+    // client does not send anything.
+    stop := make(chan struct{})
+    go func() {
+        ticker := time.NewTicker(presenceHeartbeat)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-stop:
+                return
+            case <-ticker.C:
+                _ = shared.SetUserOnline(r.Context(), userID)
+            }
+        }
+    }()
     defer func() {
-        h.removeClient(userID)
+        close(stop)
+        session.close()
+        c.stop()
+        // While draining the client is expected to reconnect to another
+        // instance, so it is left to the presence key to expire instead of
+        // being reported offline in between.
+        if h.removeClient(session) && !h.draining.Load() {
+            h.forgetPresence(userID)
+            if err := shared.SetUserOffline(r.Context(), userID); err != nil {
+                slog.ErrorContext(r.Context(), "Failed to set user offline", "error", err)
+            }
+        }
         conn.Close()
     }()
     for {
-        _ = shared.SetUserOnline(userID)
-        var msg struct {
-            Content   string  `json:"content"`
-            Recipient *string `json:"recipient"`
+        _ = shared.SetUserOnline(r.Context(), userID)
+        var msg wsMessage
+        if err := conn.ReadJSON(&msg); err != nil {
+            return
+        }
+        // Every message gets its own trace, linked to the long-lived one of
+        // the upgrade request.
+        ctx, span := tracing.StartLinked(r.Context(), "ws.message", attribute.String("ws.message.type", msg.Type))
+        h.handleWSMessage(ctx, session, msg)
+        span.End()
+    }
+}
+
+type wsMessage struct {
+    Type      string   `json:"type"`
+    Content   string   `json:"content"`
+    Recipient *string  `json:"recipient"`
+    UserIDs   []string `json:"user_ids"`
+    Token     string   `json:"token"`
+}
+
+func (h *Handler) handleWSMessage(ctx context.Context, session *wsSession, msg wsMessage) {
+    c, userID := session.client, session.userID
+    switch msg.Type {
+    case "auth":
+        if err := session.reauthenticate(ctx, msg.Token); err != nil {
+            slog.InfoContext(ctx, "WebSocket: token rejected", "error", err)
+            c.write(map[string]interface{}{"error": "invalid token"})
+            return
         }
-        err := conn.ReadJSON(&msg)
+        c.write(map[string]interface{}{"type": "auth.ok", "expires_at": session.expiresAt()})
+        return
+    case "presence.subscribe":
+        list, err := h.subscribePresence(ctx, userID, msg.UserIDs)
         if err != nil {
+            slog.ErrorContext(ctx, "WebSocket: failed to load presence", "error", err)
+            c.write(map[string]interface{}{"error": "failed to load presence"})
             return
         }
-        var recipientUserID *string
-        if msg.Recipient != nil && *msg.Recipient != "" {
-            var id string
-            err := h.service.db.QueryRowContext(
-                r.Context(),
-                `SELECT id FROM users WHERE email = $1`,
-                *msg.Recipient,
-            ).Scan(&id)
-            if err == nil {
-                recipientUserID = &id
-            }
+        for i := range list {
+            c.write(presenceEvent(&list[i]))
         }
-        if err := h.service.SaveMessage(userID, recipientUserID, msg.Content); err != nil {
-            log.Printf("WebSocket: failed to save message: %v", err)
-            continue
+        return
+    case "presence.unsubscribe":
+        h.unsubscribePresence(userID, msg.UserIDs)
+        return
+    case "", "message":
+    default:
+        c.write(map[string]interface{}{"error": "unknown message type: " + msg.Type})
+        return
+    }
+    if !session.hasScope(shared.ScopeMessagesWrite) {
+        c.write(map[string]interface{}{"error": "insufficient scope: " + shared.ScopeMessagesWrite + " required"})
+        return
+    }
+    if wait := h.limiter.Allow(ctx, ratelimit.Messages, userID, session.ip); wait > 0 {
+        c.write(map[string]interface{}{
+            "error":       "rate limit exceeded",
+            "retry_after": ratelimit.RetryAfterSeconds(wait),
+        })
+        return
+    }
+    if err := h.service.CanSendMessages(ctx, userID); err != nil {
+        if !errors.Is(err, ErrEmailNotVerified) {
+            slog.ErrorContext(ctx, "WebSocket: failed to check sender", "error", err)
         }
-        payload := map[string]interface{}{
-            "user_id":           userID,
-            "recipient_user_id": recipientUserID,
-            "content":           msg.Content,
-            "created_at":        time.Now(),
+        c.write(map[string]interface{}{"error": err.Error()})
+        return
+    }
+    var recipientUserID *string
+    if msg.Recipient != nil && *msg.Recipient != "" {
+        // An unknown recipient must not turn a private message public.
+        id, err := h.service.UserIDByEmail(ctx, *msg.Recipient)
+        if err != nil {
+            if !errors.Is(err, sql.ErrNoRows) {
+                slog.ErrorContext(ctx, "WebSocket: failed to look up recipient", "error", err)
+            }
+            c.write(map[string]interface{}{"error": "recipient user not found"})
+            return
         }
-        if recipientUserID == nil {
-            h.sendBroadcast(payload)
-        } else {
-            h.sendToUsers([]string{userID, *recipientUserID}, payload)
+        recipientUserID = &id
+    }
+    if recipientUserID != nil {
+        if err := h.service.CheckCanMessage(ctx, userID, *recipientUserID); err != nil {
+            if !errors.Is(err, ErrBlocked) {
+                slog.ErrorContext(ctx, "WebSocket: failed to check blocks", "error", err)
+            }
+            c.write(map[string]interface{}{"error": err.Error()})
+            return
         }
     }
+    if err := h.service.SaveMessage(ctx, userID, recipientUserID, msg.Content); err != nil {
+        slog.ErrorContext(ctx, "WebSocket: failed to save message", "error", err)
+        return
+    }
+    metrics.MessagesSent.WithLabelValues(messageType(recipientUserID)).Inc()
+    payload := map[string]interface{}{
+        "user_id":           userID,
+        "sender":            h.service.GetUserSummary(ctx, userID),
+        "recipient_user_id": recipientUserID,
+        "content":           msg.Content,
+        "created_at":        time.Now(),
+    }
+    if recipientUserID == nil {
+        h.sendBroadcast(ctx, userID, payload)
+    } else {
+        h.sendToUsers(ctx, []string{userID, *recipientUserID}, payload)
+    }
 }
 
 // @Summary Получить чаты пользователя
@@ -432,15 +711,28 @@ func (h *Handler) GetUserChats(w http.ResponseWriter, r *http.Request) {
         return
     }
     userID := fmt.Sprintf("%v", claims["user_id"])
-    chats, err := h.service.GetUserChats(userID, 100)
+    chats, err := h.service.GetUserChats(r.Context(), userID, 100)
     if err != nil {
         http.Error(w, "Failed to fetch chats", http.StatusInternalServerError)
         return
     }
+    ids := make([]string, len(chats))
     for i := range chats {
-        otherUserID := chats[i].UserID
-        isOnline, _ := shared.IsUserOnline(otherUserID)
-        chats[i].IsOnline = isOnline
+        ids[i] = chats[i].UserID
+    }
+    list, err := h.presence.Lookup(r.Context(), userID, ids)
+    if err != nil {
+        slog.ErrorContext(r.Context(), "Failed to load presence of chats", "error", err)
+    }
+    byUser := make(map[string]*presence.Presence, len(list))
+    for i := range list {
+        byUser[list[i].UserID] = &list[i]
+    }
+    for i := range chats {
+        if p := byUser[chats[i].UserID]; p != nil {
+            chats[i].IsOnline = p.Online()
+            chats[i].Presence = p
+        }
     }
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(chats)
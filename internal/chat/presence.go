@@ -0,0 +1,187 @@
+package chat
+
+import (
+    "RealtimeChat/internal/presence"
+    "RealtimeChat/internal/tracing"
+    "context"
+    "log/slog"
+    "time"
+
+    "github.com/google/uuid"
+)
+
+// maxPresenceSubscriptions bounds how many users one connection may watch
+// in addition to its conversation partners.
+const maxPresenceSubscriptions = 200
+
+// WatchPresence pushes presence.changed events to the connected clients
+// until ctx is cancelled.
+func (h *Handler) WatchPresence(ctx context.Context) {
+    h.presence.Watch(ctx, h.notifyPresence)
+}
+
+// notifyPresence sends the new presence of userID to the local clients who
+// have a conversation with them or subscribed to them. A client only gets
+// an event when what it is allowed to see actually changed, so invisible
+// users and blocked users produce no events.
+func (h *Handler) notifyPresence(ctx context.Context, userID string) {
+    ctx, span := tracing.Start(ctx, "presence.notify")
+    defer span.End()
+    ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+    defer cancel()
+
+    h.clientsMu.RLock()
+    connected := make([]string, 0, len(h.clients))
+    for id := range h.clients {
+        if id != userID {
+            connected = append(connected, id)
+        }
+    }
+    h.clientsMu.RUnlock()
+    if len(connected) == 0 {
+        return
+    }
+
+    watchers, err := h.service.ConversationPartners(ctx, userID, connected)
+    if err != nil {
+        slog.ErrorContext(ctx, "Presence: failed to load conversation partners", "user_id", userID, "error", err)
+        watchers = map[string]bool{}
+    }
+    h.presenceMu.Lock()
+    for watcher := range h.subscribers[userID] {
+        watchers[watcher] = true
+    }
+    h.presenceMu.Unlock()
+
+    ids := make([]string, 0, len(watchers))
+    for watcher := range watchers {
+        ids = append(ids, watcher)
+    }
+    seen, err := h.presence.LookupWatchers(ctx, userID, ids)
+    if err != nil {
+        slog.ErrorContext(ctx, "Presence: failed to load presence", "user_id", userID, "error", err)
+        return
+    }
+    for watcher, p := range seen {
+        if h.presenceChanged(watcher, &p) {
+            h.sendToUsers(ctx, []string{watcher}, presenceEvent(&p))
+        }
+    }
+}
+
+func presenceEvent(p *presence.Presence) map[string]interface{} {
+    return map[string]interface{}{
+        "type":     "presence.changed",
+        "presence": p,
+    }
+}
+
+// presenceChanged records what watcher was last told about p.UserID and
+// reports whether p differs from it. Nothing sent yet counts as offline.
+func (h *Handler) presenceChanged(watcher string, p *presence.Presence) bool {
+    key := p.State
+    if p.Status != nil {
+        key += "|" + p.Status.Text
+    }
+
+    h.presenceMu.Lock()
+    defer h.presenceMu.Unlock()
+    seen := h.lastPresence[watcher]
+    if seen == nil {
+        seen = make(map[string]string)
+        h.lastPresence[watcher] = seen
+    }
+    prev, ok := seen[p.UserID]
+    if !ok {
+        prev = presence.StateOffline
+    }
+    if prev == key {
+        return false
+    }
+    seen[p.UserID] = key
+    return true
+}
+
+// subscribePresence adds userIDs to the users watched by watcher and returns
+// their current presence. Invalid ids are skipped.
+func (h *Handler) subscribePresence(ctx context.Context, watcher string, userIDs []string) ([]presence.Presence, error) {
+    var ids []string
+    h.presenceMu.Lock()
+    for _, id := range userIDs {
+        if _, err := uuid.Parse(id); err != nil || id == watcher {
+            continue
+        }
+        if h.subscriptions[watcher] == nil {
+            h.subscriptions[watcher] = make(map[string]bool)
+        }
+        if !h.subscriptions[watcher][id] && len(h.subscriptions[watcher]) >= maxPresenceSubscriptions {
+            break
+        }
+        h.subscriptions[watcher][id] = true
+        if h.subscribers[id] == nil {
+            h.subscribers[id] = make(map[string]bool)
+        }
+        h.subscribers[id][watcher] = true
+        ids = append(ids, id)
+    }
+    h.presenceMu.Unlock()
+
+    list, err := h.presence.Lookup(ctx, watcher, ids)
+    if err != nil {
+        return nil, err
+    }
+    for i := range list {
+        h.presenceChanged(watcher, &list[i])
+    }
+    return list, nil
+}
+
+func (h *Handler) unsubscribePresence(watcher string, userIDs []string) {
+    h.presenceMu.Lock()
+    defer h.presenceMu.Unlock()
+    for _, id := range userIDs {
+        delete(h.subscriptions[watcher], id)
+        delete(h.subscribers[id], watcher)
+        if len(h.subscribers[id]) == 0 {
+            delete(h.subscribers, id)
+        }
+    }
+}
+
+// seedPresence records the current presence of the chat partners of a newly
+// connected client, so that its first events are relative to what it could
+// already see through GET /chats.
+func (h *Handler) seedPresence(ctx context.Context, watcher string) {
+    chats, err := h.service.GetUserChats(ctx, watcher, 100)
+    if err != nil {
+        slog.ErrorContext(ctx, "Presence: failed to load chats", "error", err)
+        return
+    }
+    ids := make([]string, len(chats))
+    for i := range chats {
+        ids[i] = chats[i].UserID
+    }
+    list, err := h.presence.Lookup(ctx, watcher, ids)
+    if err != nil {
+        slog.ErrorContext(ctx, "Presence: failed to load presence", "error", err)
+        return
+    }
+    for i := range list {
+        h.presenceChanged(watcher, &list[i])
+    }
+}
+
+// forgetPresence drops the subscriptions and sent state of a disconnected
+// client.
+func (h *Handler) forgetPresence(watcher string) {
+    h.presenceMu.Lock()
+    defer h.presenceMu.Unlock()
+    for id := range h.subscriptions[watcher] {
+        delete(h.subscribers[id], watcher)
+        if len(h.subscribers[id]) == 0 {
+            delete(h.subscribers, id)
+        }
+    }
+    delete(h.subscriptions, watcher)
+    delete(h.lastPresence, watcher)
+}
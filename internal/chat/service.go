@@ -2,38 +2,146 @@ package chat
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
+	"strings"
 	"sync"
 	"time"
 
 	"RealtimeChat/internal/auth/models"
+	"RealtimeChat/internal/config"
+	"RealtimeChat/internal/presence"
 	"RealtimeChat/internal/shared"
+	"RealtimeChat/internal/tracing"
 
 	"github.com/gorilla/websocket"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	ErrEmailNotVerified = errors.New("email not verified")
+	ErrBlocked          = errors.New("you cannot message this user")
 )
 
 type Service struct {
 	db      *shared.DB
+	cfg     *config.Config
+	storage shared.Storage
 	clients map[string]*websocket.Conn
 	mu      sync.RWMutex
 }
 
-func NewService(db *shared.DB) *Service {
+func NewService(db *shared.DB, cfg *config.Config, storage shared.Storage) *Service {
 	return &Service{
 		db:      db,
+		cfg:     cfg,
+		storage: storage,
 		clients: make(map[string]*websocket.Conn),
 	}
 }
 
+// CanSendMessages reports ErrEmailNotVerified when the verification policy is
+// enabled and the user has not confirmed their email yet.
+func (s *Service) CanSendMessages(ctx context.Context, userID string) error {
+	if !s.cfg.Auth.RequireEmailVerification {
+		return nil
+	}
+	var verified bool
+	err := s.db.QueryRowContext(
+		ctx,
+		`SELECT email_verified_at IS NOT NULL FROM users WHERE id = $1`,
+		userID,
+	).Scan(&verified)
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return ErrEmailNotVerified
+	}
+	return nil
+}
+
+// IsBlocked reports whether either user has blocked the other.
+func (s *Service) IsBlocked(ctx context.Context, userID, otherUserID string) (bool, error) {
+	var blocked bool
+	err := s.db.QueryRowContext(
+		ctx,
+		`SELECT EXISTS (
+            SELECT 1 FROM user_blocks
+            WHERE kind = 'block'
+              AND ((blocker_id = $1 AND blocked_id = $2) OR (blocker_id = $2 AND blocked_id = $1))
+        )`,
+		userID, otherUserID,
+	).Scan(&blocked)
+	return blocked, err
+}
+
+// CheckCanMessage returns ErrBlocked when a block exists between sender and recipient.
+func (s *Service) CheckCanMessage(ctx context.Context, senderID, recipientUserID string) error {
+	blocked, err := s.IsBlocked(ctx, senderID, recipientUserID)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return ErrBlocked
+	}
+	return nil
+}
+
+// ConversationPartners returns which of candidates have a direct
+// conversation with userID.
+func (s *Service) ConversationPartners(ctx context.Context, userID string, candidates []string) (map[string]bool, error) {
+	query := `
+        SELECT DISTINCT CASE WHEN m.user_id = $1 THEN m.recipient_user_id ELSE m.user_id END
+        FROM messages m
+        WHERE (m.user_id = $1 AND m.recipient_user_id = ANY($2::uuid[]))
+           OR (m.recipient_user_id = $1 AND m.user_id = ANY($2::uuid[]))
+    `
+	rows, err := s.db.QueryContext(ctx, query, userID, pq.Array(candidates))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	partners := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		partners[id] = true
+	}
+	return partners, rows.Err()
+}
+
+// HiddenFrom returns the users who blocked or muted senderID and therefore
+// must not receive their public messages.
+func (s *Service) HiddenFrom(ctx context.Context, senderID string) (map[string]bool, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT blocker_id FROM user_blocks WHERE blocked_id = $1`, senderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hidden := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		hidden[id] = true
+	}
+	return hidden, rows.Err()
+}
+
 func (s *Service) AddClient(userID string, conn *websocket.Conn) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if old, exists := s.clients[userID]; exists && old != nil {
-		log.Printf("WebSocket: closing old conn for user %s", userID)
+		slog.Info("WebSocket: closing old connection", "user_id", userID)
 		old.Close()
 	}
 	s.clients[userID] = conn
-	log.Printf("WebSocket: connected user %s, total: %d", userID, len(s.clients))
+	slog.Info("WebSocket: connected", "user_id", userID, "total", len(s.clients))
 }
 
 func (s *Service) RemoveClient(userID string) {
@@ -41,7 +149,7 @@ func (s *Service) RemoveClient(userID string) {
 	defer s.mu.Unlock()
 	if _, ok := s.clients[userID]; ok {
 		delete(s.clients, userID)
-		log.Printf("WebSocket: removed user %s, total: %d", userID, len(s.clients))
+		slog.Info("WebSocket: removed", "user_id", userID, "total", len(s.clients))
 	}
 }
 
@@ -51,7 +159,7 @@ func (s *Service) BroadcastMessage(senderID string, recipientUserID *string, pay
 	if recipientUserID == nil {
 		for userID, conn := range s.clients {
 			if err := conn.WriteJSON(payload); err != nil {
-				log.Printf("BroadcastMessage: failed for %s: %v", userID, err)
+				slog.Warn("BroadcastMessage: write failed", "recipient_id", userID, "error", err)
 			}
 		}
 	} else {
@@ -59,29 +167,36 @@ func (s *Service) BroadcastMessage(senderID string, recipientUserID *string, pay
 		for _, userID := range sendTo {
 			if conn, ok := s.clients[userID]; ok && conn != nil {
 				if err := conn.WriteJSON(payload); err != nil {
-					log.Printf("BroadcastMessage: failed for %s: %v", userID, err)
+					slog.Warn("BroadcastMessage: write failed", "recipient_id", userID, "error", err)
 				}
 			}
 		}
 	}
 }
 
-func (s *Service) GetGeneralMessages(limit int) ([]models.MessageWithAttachment, error) {
+// GetGeneralMessages returns the public chat as seen by viewerID, without
+// messages from users the viewer blocked or muted.
+func (s *Service) GetGeneralMessages(viewerID string, limit int) ([]models.MessageWithAttachment, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	query := `
         SELECT m.id, m.user_id, m.recipient_user_id, m.content, m.created_at,
-               a.file_name, a.file_path, a.mime_type
+               a.file_name, a.file_path, a.mime_type,
+               su.display_name, su.avatar_path
         FROM messages m
+        JOIN users su ON su.id = m.user_id
         LEFT JOIN attachments a ON a.message_id = m.id
         WHERE m.recipient_user_id IS NULL
+          AND NOT EXISTS (
+                SELECT 1 FROM user_blocks b WHERE b.blocker_id = $2 AND b.blocked_id = m.user_id
+          )
         ORDER BY m.created_at DESC
         LIMIT $1
     `
-	rows, err := s.db.QueryContext(ctx, query, limit)
+	rows, err := s.db.QueryContext(ctx, query, limit, viewerID)
 	if err != nil {
-		log.Printf("GetGeneralMessages: query failed: %v", err)
+		slog.Error("GetGeneralMessages: query failed", "error", err)
 		return nil, err
 	}
 	defer rows.Close()
@@ -90,6 +205,7 @@ func (s *Service) GetGeneralMessages(limit int) ([]models.MessageWithAttachment,
 	for rows.Next() {
 		var m models.MessageWithAttachment
 		var fileName, filePath, mimeType *string
+		var displayName, avatarPath *string
 		if err := rows.Scan(
 			&m.ID,
 			&m.UserID,
@@ -99,10 +215,13 @@ func (s *Service) GetGeneralMessages(limit int) ([]models.MessageWithAttachment,
 			&fileName,
 			&filePath,
 			&mimeType,
+			&displayName,
+			&avatarPath,
 		); err != nil {
-			log.Printf("GetGeneralMessages: row scan failed: %v", err)
+			slog.Error("GetGeneralMessages: row scan failed", "error", err)
 			return nil, err
 		}
+		m.Sender = userSummary(m.UserID, displayName, avatarPath)
 		if fileName != nil && filePath != nil && mimeType != nil {
 			m.Attachment = &models.AttachmentInfo{
 				FileName: *fileName,
@@ -115,21 +234,34 @@ func (s *Service) GetGeneralMessages(limit int) ([]models.MessageWithAttachment,
 	return messages, nil
 }
 
+// UserIDByEmail finds a user by email regardless of case, matching how
+// emails are normalized on registration. It returns sql.ErrNoRows when there
+// is no such user.
+func (s *Service) UserIDByEmail(ctx context.Context, email string) (string, error) {
+	var id string
+	err := s.db.QueryRowContext(ctx,
+		`SELECT id FROM users WHERE lower(email) = $1`,
+		strings.ToLower(strings.TrimSpace(email)),
+	).Scan(&id)
+	return id, err
+}
+
 func (s *Service) GetConversationMessages(currentUserID, otherUsername string, limit int) ([]models.MessageWithAttachment, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	var otherUserID string
-	err := s.db.QueryRowContext(ctx, `SELECT id FROM users WHERE email = $1`, otherUsername).Scan(&otherUserID)
+	otherUserID, err := s.UserIDByEmail(ctx, otherUsername)
 	if err != nil {
-		log.Printf("GetConversationMessages: cannot find user %s: %v", otherUsername, err)
+		slog.Warn("GetConversationMessages: cannot find user", "error", err)
 		return nil, err
 	}
 
 	query := `
         SELECT m.id, m.user_id, m.recipient_user_id, m.content, m.created_at,
-               a.file_name, a.file_path, a.mime_type
+               a.file_name, a.file_path, a.mime_type,
+               su.display_name, su.avatar_path
         FROM messages m
+        JOIN users su ON su.id = m.user_id
         LEFT JOIN attachments a ON a.message_id = m.id
         WHERE 
             (m.user_id = $1 AND m.recipient_user_id = $2)
@@ -140,7 +272,7 @@ func (s *Service) GetConversationMessages(currentUserID, otherUsername string, l
     `
 	rows, err := s.db.QueryContext(ctx, query, currentUserID, otherUserID, limit)
 	if err != nil {
-		log.Printf("GetConversationMessages: query failed: %v", err)
+		slog.Error("GetConversationMessages: query failed", "error", err)
 		return nil, err
 	}
 	defer rows.Close()
@@ -149,6 +281,7 @@ func (s *Service) GetConversationMessages(currentUserID, otherUsername string, l
 	for rows.Next() {
 		var m models.MessageWithAttachment
 		var fileName, filePath, mimeType *string
+		var displayName, avatarPath *string
 		if err := rows.Scan(
 			&m.ID,
 			&m.UserID,
@@ -158,10 +291,13 @@ func (s *Service) GetConversationMessages(currentUserID, otherUsername string, l
 			&fileName,
 			&filePath,
 			&mimeType,
+			&displayName,
+			&avatarPath,
 		); err != nil {
-			log.Printf("GetConversationMessages: row scan failed: %v", err)
+			slog.Error("GetConversationMessages: row scan failed", "error", err)
 			return nil, err
 		}
+		m.Sender = userSummary(m.UserID, displayName, avatarPath)
 		if fileName != nil && filePath != nil && mimeType != nil {
 			m.Attachment = &models.AttachmentInfo{
 				FileName: *fileName,
@@ -174,52 +310,80 @@ func (s *Service) GetConversationMessages(currentUserID, otherUsername string, l
 	return messages, nil
 }
 
-func (s *Service) SaveMessage(userID string, recipientUserID *string, content string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// SaveMessage stores a message. The insert is not cancelled with ctx, so a
+// message accepted before shutdown is still written.
+func (s *Service) SaveMessage(ctx context.Context, userID string, recipientUserID *string, content string) (err error) {
+	ctx, span := tracing.Start(ctx, "chat.SaveMessage", insertMessageAttrs...)
+	defer tracing.End(span, &err)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
 	defer cancel()
 	query := `INSERT INTO messages (user_id, recipient_user_id, content) VALUES ($1, $2, $3)`
-	_, err := s.db.ExecContext(ctx, query, userID, recipientUserID, content)
+	_, err = s.db.ExecContext(ctx, query, userID, recipientUserID, content)
 	if err != nil {
-		log.Printf("SaveMessage: insert failed (userID=%s recipientUserID=%v content='%s'): %v", userID, recipientUserID, content, err)
+		slog.ErrorContext(ctx, "SaveMessage: insert failed", "sender_id", userID, "recipient_id", recipientUserID, "error", err)
 	}
 	return err
 }
 
+var insertMessageAttrs = []attribute.KeyValue{
+	attribute.String("db.system.name", "postgresql"),
+	attribute.String("db.operation.name", "INSERT"),
+	attribute.String("db.collection.name", "messages"),
+}
+
 func (s *Service) SaveAttachment(messageID, userID, filePath, fileName, mimeType string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	query := `INSERT INTO attachments (message_id, user_id, file_path, file_name, mime_type) VALUES ($1, $2, $3, $4, $5)`
 	_, err := s.db.ExecContext(ctx, query, messageID, userID, filePath, fileName, mimeType)
 	if err != nil {
-		log.Printf("SaveAttachment: insert failed (messageID=%s userID=%s file=%s): %v", messageID, userID, filePath, err)
+		slog.Error("SaveAttachment: insert failed", "message_id", messageID, "sender_id", userID, "path", filePath, "error", err)
 	}
 	return err
 }
 
-func (s *Service) SaveMessageWithID(messageID, userID string, recipientUserID *string, content string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (s *Service) SaveMessageWithID(ctx context.Context, messageID, userID string, recipientUserID *string, content string) (err error) {
+	ctx, span := tracing.Start(ctx, "chat.SaveMessageWithID", insertMessageAttrs...)
+	defer tracing.End(span, &err)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
 	defer cancel()
 	query := `INSERT INTO messages (id, user_id, recipient_user_id, content) VALUES ($1, $2, $3, $4)`
-	_, err := s.db.ExecContext(ctx, query, messageID, userID, recipientUserID, content)
+	_, err = s.db.ExecContext(ctx, query, messageID, userID, recipientUserID, content)
 	if err != nil {
-		log.Printf("SaveMessageWithID: insert failed (messageID=%s userID=%s recipientUserID=%v content='%s'): %v", messageID, userID, recipientUserID, content, err)
+		slog.ErrorContext(ctx, "SaveMessageWithID: insert failed", "message_id", messageID, "sender_id", userID, "recipient_id", recipientUserID, "error", err)
 	}
 	return err
 }
 
 type ChatPreview struct {
-	UserID        string    `json:"user_id"`
-	Email         string    `json:"email"`
+	UserID        string             `json:"user_id"`
+	Email         string             `json:"email"`
+	User          models.UserSummary `json:"user"`
 	LastMessage   string    `json:"last_message"`
 	LastTimestamp time.Time `json:"last_timestamp"`
 	IsOnline      bool      `json:"is_online"`
+	// Presence is the state, custom status and last seen of the other user.
+	Presence *presence.Presence `json:"presence,omitempty"`
+	// Blocked is set when either side blocked the other; presence is hidden then.
+	Blocked bool `json:"blocked"`
 }
 
-func (s *Service) GetUserChats(currentUserID string, limit int) ([]ChatPreview, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (s *Service) GetUserChats(ctx context.Context, currentUserID string, limit int) (_ []ChatPreview, err error) {
+	ctx, span := tracing.Start(ctx, "chat.GetUserChats",
+		attribute.String("db.system.name", "postgresql"),
+		attribute.String("db.operation.name", "SELECT"),
+		attribute.String("db.collection.name", "messages"),
+	)
+	defer tracing.End(span, &err)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 	query := `
-        SELECT u.id, u.email, COALESCE(m.content, ''), m.created_at
+        SELECT u.id, u.email, COALESCE(m.content, ''), m.created_at, u.display_name, u.avatar_path,
+               EXISTS (
+                    SELECT 1 FROM user_blocks b
+                    WHERE b.kind = 'block'
+                      AND ((b.blocker_id = $1 AND b.blocked_id = u.id) OR (b.blocker_id = u.id AND b.blocked_id = $1))
+               )
         FROM (
             SELECT DISTINCT 
                 CASE WHEN m.user_id = $1 THEN m.recipient_user_id ELSE m.user_id END as buddy_id
@@ -228,6 +392,7 @@ func (s *Service) GetUserChats(currentUserID string, limit int) ([]ChatPreview,
                OR (m.recipient_user_id = $1)
         ) dialogs
         JOIN users u ON u.id = dialogs.buddy_id
+            AND ($3 = FALSE OR u.email_verified_at IS NOT NULL)
         JOIN LATERAL (
             SELECT content, created_at 
             FROM messages 
@@ -238,7 +403,7 @@ func (s *Service) GetUserChats(currentUserID string, limit int) ([]ChatPreview,
         ORDER BY m.created_at DESC          
         LIMIT $2
     `
-	rows, err := s.db.QueryContext(ctx, query, currentUserID, limit)
+	rows, err := s.db.QueryContext(ctx, query, currentUserID, limit, s.cfg.Auth.RequireEmailVerification)
 	if err != nil {
 		return nil, err
 	}
@@ -246,10 +411,35 @@ func (s *Service) GetUserChats(currentUserID string, limit int) ([]ChatPreview,
 	var res []ChatPreview
 	for rows.Next() {
 		var c ChatPreview
-		if err := rows.Scan(&c.UserID, &c.Email, &c.LastMessage, &c.LastTimestamp); err != nil {
+		var displayName, avatarPath *string
+		if err := rows.Scan(&c.UserID, &c.Email, &c.LastMessage, &c.LastTimestamp, &displayName, &avatarPath, &c.Blocked); err != nil {
 			return nil, err
 		}
+		c.User = *userSummary(c.UserID, displayName, avatarPath)
 		res = append(res, c)
 	}
 	return res, nil
 }
+
+func userSummary(userID string, displayName, avatarPath *string) *models.UserSummary {
+	summary := &models.UserSummary{ID: userID, AvatarURL: models.AvatarURL(userID, avatarPath)}
+	if displayName != nil {
+		summary.DisplayName = *displayName
+	}
+	return summary
+}
+
+// GetUserSummary loads the compact profile attached to outgoing messages.
+func (s *Service) GetUserSummary(ctx context.Context, userID string) *models.UserSummary {
+	var displayName, avatarPath *string
+	err := s.db.QueryRowContext(
+		ctx,
+		`SELECT display_name, avatar_path FROM users WHERE id = $1`,
+		userID,
+	).Scan(&displayName, &avatarPath)
+	if err != nil {
+		slog.Error("GetUserSummary: failed", "profile_id", userID, "error", err)
+		return &models.UserSummary{ID: userID}
+	}
+	return userSummary(userID, displayName, avatarPath)
+}
@@ -0,0 +1,158 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"RealtimeChat/internal/shared"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+// closeTokenExpired is sent when the token of a connection expires; the
+// client should reconnect with a fresh token or ticket. Codes from 4000 are
+// reserved for applications.
+const closeTokenExpired = 4001
+
+var tokenExpired = websocket.FormatCloseMessage(closeTokenExpired, "token expired")
+
+// closeTokenRevoked is sent when the tokens of the user are revoked, e.g.
+// because the account was deleted.
+const closeTokenRevoked = 4003
+
+var tokenRevoked = websocket.FormatCloseMessage(closeTokenRevoked, "token revoked")
+
+// closeGrace is how long a client may take to answer a close frame before
+// its connection is dropped.
+const closeGrace = 5 * time.Second
+
+var (
+	errOtherUser     = errors.New("token belongs to another user")
+	errMissingScope  = errors.New("token lacks the " + shared.ScopeMessagesRead + " scope")
+	errSessionClosed = errors.New("connection is being closed")
+)
+
+// wsSession is the authentication of one WebSocket connection. It is used by
+// the read loop, the expiry timer and revocation events, so the claims and
+// the closing state are guarded by mu.
+type wsSession struct {
+	client *client
+	userID string
+	ip     string
+
+	mu     sync.Mutex
+	claims jwt.MapClaims
+	expiry *time.Timer
+	// closing is set once a close frame was sent; the token can no longer
+	// be renewed then.
+	closing bool
+}
+
+func newWSSession(c *client, ip string, claims jwt.MapClaims) *wsSession {
+	s := &wsSession{client: c, userID: c.userID, ip: ip}
+	s.setClaims(claims)
+	return s
+}
+
+// setClaims authenticates the connection with claims and schedules its close
+// for when they expire. Tokens without expiry, such as API tokens, keep the
+// connection open. It fails once the connection is being closed, including
+// when the previous token expired but expire has not run yet.
+func (s *wsSession) setClaims(claims jwt.MapClaims) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing || (s.expiry != nil && !s.expiry.Stop()) {
+		return errSessionClosed
+	}
+	s.claims = claims
+	s.expiry = nil
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		s.expiry = time.AfterFunc(time.Until(exp.Time), s.expire)
+	}
+	return nil
+}
+
+// hasScope reports whether the current token grants scope.
+func (s *wsSession) hasScope(scope string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return shared.HasScope(s.claims, scope)
+}
+
+// expiresAt returns the expiry of the current token, or nil.
+func (s *wsSession) expiresAt() *time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exp, err := s.claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return nil
+	}
+	return &exp.Time
+}
+
+func (s *wsSession) expire() {
+	s.closeWith(tokenExpired)
+}
+
+// revoke closes the connection because the tokens of its user were revoked.
+// A non-empty tokenID only concerns connections using that API token.
+func (s *wsSession) revoke(tokenID string) {
+	s.mu.Lock()
+	current, _ := s.claims["token_id"].(string)
+	s.mu.Unlock()
+	if tokenID != "" && tokenID != current {
+		return
+	}
+	s.closeWith(tokenRevoked)
+}
+
+// closeWith sends the close frame msg once and drops the connection if the
+// client does not answer within closeGrace.
+func (s *wsSession) closeWith(msg []byte) {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return
+	}
+	s.closing = true
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+	s.mu.Unlock()
+
+	conn := s.client.conn
+	// WriteControl may be called concurrently with the other writers.
+	if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+		conn.Close()
+		return
+	}
+	// The read loop ends once the client answers, or after closeGrace.
+	conn.SetReadDeadline(time.Now().Add(closeGrace))
+}
+
+// reauthenticate switches the connection to token, which must belong to the
+// same user and be allowed on /ws, so a client can renew its token without
+// reconnecting.
+func (s *wsSession) reauthenticate(ctx context.Context, token string) error {
+	claims, err := shared.ParseAccessToken(ctx, token)
+	if err != nil {
+		return err
+	}
+	if userID, _ := claims["user_id"].(string); userID != s.userID {
+		return errOtherUser
+	}
+	if !shared.HasScope(claims, shared.ScopeMessagesRead) {
+		return errMissingScope
+	}
+	return s.setClaims(claims)
+}
+
+func (s *wsSession) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+}
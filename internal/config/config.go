@@ -1,58 +1,237 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"reflect"
+	"time"
 
 	"github.com/joho/godotenv"
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Server   Server   `yaml:"server"`
-	Database Database `yaml:"database"`
-	Redis Redis `yaml:"redis"`
+	Server   Server   `yaml:"server" env-prefix:"SERVER_"`
+	Database Database `yaml:"database" env-prefix:"DB_"`
+	Redis    Redis    `yaml:"redis" env-prefix:"REDIS_"`
+	State    State    `yaml:"state" env-prefix:"STATE_"`
+	Mail     Mail     `yaml:"mail" env-prefix:"MAIL_"`
+	Storage  Storage  `yaml:"storage" env-prefix:"STORAGE_"`
+	Privacy  Privacy  `yaml:"privacy" env-prefix:"PRIVACY_"`
+	Auth     Auth     `yaml:"auth" env-prefix:"AUTH_"`
+	Log      Log      `yaml:"log" env-prefix:"LOG_"`
+	Tracing  Tracing  `yaml:"tracing" env-prefix:"TRACING_"`
+	// RateLimit is applied on top of the login throttle in Auth.
+	RateLimit RateLimit `yaml:"rate_limit" env-prefix:"RATE_LIMIT_"`
 }
 
 type Server struct {
-	Host string `yaml:"host" env-default:":8080"`
-	Port string `yaml:"port" env-default:"localhost"`
+	Host string `yaml:"host" env:"HOST" env-default:"localhost"`
+	Port string `yaml:"port" env:"PORT" env-default:"8080"`
+	// PublicURL is the externally reachable base URL used in links sent to users.
+	PublicURL string `yaml:"public_url" env:"PUBLIC_URL" env-default:"http://localhost:8080"`
+	// AllowedOrigins are the browser origins, such as
+	// "https://chat.example.com", allowed to open WebSockets and call the
+	// API cross-origin, in addition to the origin of PublicURL. "*" allows
+	// any origin.
+	AllowedOrigins []string `yaml:"allowed_origins" env:"ALLOWED_ORIGINS"`
+	// The timeouts do not apply to WebSocket connections once upgraded.
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"READ_HEADER_TIMEOUT" env-default:"10s"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" env:"READ_TIMEOUT" env-default:"1m"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" env:"WRITE_TIMEOUT" env-default:"1m"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" env:"IDLE_TIMEOUT" env-default:"2m"`
+	// ShutdownTimeout bounds how long requests, WebSocket clients and
+	// background jobs are waited for after SIGTERM.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" env-default:"30s"`
+	// ShutdownDelay keeps serving with /readyz failing for this long after
+	// SIGTERM before the listener is closed, giving load balancers time to
+	// notice.
+	ShutdownDelay time.Duration `yaml:"shutdown_delay" env:"SHUTDOWN_DELAY" env-default:"0s"`
 }
 
 type Database struct {
-	Name     string `yaml:"name" env-default:"postgres"`
-	User     string `yaml:"user" env-default:"postgres"`
-	Password string `yaml:"password" env-default:"postgres"`
-	Host     string `yaml:"host" env-default:"localhost"`
-	Port     string `yaml:"port" env-default:"5432"`
+	Name     string `yaml:"name" env:"NAME" env-default:"postgres"`
+	User     string `yaml:"user" env:"USER" env-default:"postgres"`
+	Password string `yaml:"password" env:"PASSWORD" env-default:"postgres"`
+	Host     string `yaml:"host" env:"HOST" env-default:"localhost"`
+	Port     string `yaml:"port" env:"PORT" env-default:"5432"`
+	// AutoMigrate applies pending migrations on server start. Without it
+	// they are applied with "realtime-chat migrate up".
+	AutoMigrate bool `yaml:"auto_migrate" env:"AUTO_MIGRATE" env-default:"true"`
 }
 
 type Redis struct {
-	Host string `yaml:"host"`
-	Port string `yaml:"port"`
+	Host     string `yaml:"host" env:"HOST" env-default:"localhost"`
+	Port     string `yaml:"port" env:"PORT" env-default:"6379"`
+	Password string `yaml:"password" env:"PASSWORD"`
+	DB       int    `yaml:"db" env:"DB"`
 }
 
-func MustLoad() *Config {
-	configPath := "config/default.yaml"
+// State selects where presence, pub/sub, login throttling and token
+// revocation live: "redis" for any number of instances, or "memory" for a
+// single instance that runs with PostgreSQL only.
+type State struct {
+	Backend string `yaml:"backend" env:"BACKEND" env-default:"redis"`
+}
 
-	if err := godotenv.Load(); err != nil {
-		panic(fmt.Sprintf("ошибка загрузки файла .env: %v", err))
-	}
+// Log configures the slog output. Level is debug, info, warn or error;
+// Format is json or text.
+type Log struct {
+	Level  string `yaml:"level" env:"LEVEL" env-default:"info"`
+	Format string `yaml:"format" env:"FORMAT" env-default:"json"`
+}
+
+// Tracing selects where OpenTelemetry spans go: "none", "stdout" for local
+// runs, or "otlp" over HTTP. An empty Endpoint leaves the OTLP exporter to
+// the standard OTEL_EXPORTER_OTLP_* variables.
+type Tracing struct {
+	Exporter    string  `yaml:"exporter" env:"EXPORTER" env-default:"none"`
+	Endpoint    string  `yaml:"endpoint" env:"ENDPOINT"`
+	Insecure    bool    `yaml:"insecure" env:"INSECURE" env-default:"false"`
+	ServiceName string  `yaml:"service_name" env:"SERVICE_NAME" env-default:"realtimechat"`
+	SampleRatio float64 `yaml:"sample_ratio" env:"SAMPLE_RATIO" env-default:"1"`
+}
+
+// RateLimit bounds how many requests one user and one IP may make per
+// minute in each budget: messages (REST and WebSocket), attachment uploads
+// and the auth endpoints. Up to the whole minute's budget may be spent at
+// once. Zero disables a limit.
+type RateLimit struct {
+	Enabled            bool `yaml:"enabled" env:"ENABLED" env-default:"true"`
+	MessagesPerUser    int  `yaml:"messages_per_user" env:"MESSAGES_PER_USER" env-default:"30"`
+	MessagesPerIP      int  `yaml:"messages_per_ip" env:"MESSAGES_PER_IP" env-default:"120"`
+	AttachmentsPerUser int  `yaml:"attachments_per_user" env:"ATTACHMENTS_PER_USER" env-default:"10"`
+	AttachmentsPerIP   int  `yaml:"attachments_per_ip" env:"ATTACHMENTS_PER_IP" env-default:"30"`
+	AuthPerUser        int  `yaml:"auth_per_user" env:"AUTH_PER_USER" env-default:"10"`
+	AuthPerIP          int  `yaml:"auth_per_ip" env:"AUTH_PER_IP" env-default:"20"`
+}
+
+type Storage struct {
+	Dir string `yaml:"dir" env:"DIR" env-default:"storage"`
+}
+
+type Privacy struct {
+	// DeletionPolicy decides what happens to the messages of a deleted
+	// account: "anonymize" keeps them, including their text, under an
+	// anonymous author so conversations stay readable for the other side;
+	// "delete" removes them.
+	DeletionPolicy string `yaml:"deletion_policy" env:"DELETION_POLICY" env-default:"anonymize"`
+}
+
+// Mail describes the SMTP relay. When Host is empty emails are only logged.
+type Mail struct {
+	Host     string `yaml:"host" env:"HOST"`
+	Port     string `yaml:"port" env:"PORT" env-default:"587"`
+	Username string `yaml:"username" env:"USERNAME"`
+	Password string `yaml:"password" env:"PASSWORD"`
+	From     string `yaml:"from" env:"FROM" env-default:"no-reply@realtimechat.local"`
+}
+
+type Auth struct {
+	// RequireEmailVerification forbids unverified accounts from sending
+	// messages and hides them from chat lists.
+	RequireEmailVerification bool           `yaml:"require_email_verification" env:"REQUIRE_EMAIL_VERIFICATION" env-default:"false"`
+	VerificationTokenTTL     time.Duration  `yaml:"verification_token_ttl" env:"VERIFICATION_TOKEN_TTL" env-default:"24h"`
+	Password                 PasswordPolicy `yaml:"password" env-prefix:"PASSWORD_"`
+	// TOTPIssuer is the account issuer shown in authenticator apps.
+	TOTPIssuer  string        `yaml:"totp_issuer" env:"TOTP_ISSUER" env-default:"RealtimeChat"`
+	MFATokenTTL time.Duration `yaml:"mfa_token_ttl" env:"MFA_TOKEN_TTL" env-default:"5m"`
+	Throttle    LoginThrottle `yaml:"login_throttle" env-prefix:"LOGIN_THROTTLE_"`
+	// OIDCProviders are external identity providers keyed by the name used
+	// in /oauth/{provider}/login.
+	OIDCProviders map[string]OIDCProvider `yaml:"oidc_providers" env-prefix:"OIDC_"`
+	SigningKeys   SigningKeys             `yaml:"signing_keys" env-prefix:"SIGNING_KEYS_"`
+}
 
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		panic(fmt.Sprintf("конфигурационный файл не существует: %s", configPath))
+// SigningKeys configures JWT key rotation. When Dir is empty the single pair
+// config/private.pem and config/public.pem is used instead.
+type SigningKeys struct {
+	Dir string `yaml:"dir" env:"DIR"`
+	// ActiveKeyID selects the signing key; empty means the greatest kid.
+	ActiveKeyID    string        `yaml:"active_kid" env:"ACTIVE_KID"`
+	ReloadInterval time.Duration `yaml:"reload_interval" env:"RELOAD_INTERVAL" env-default:"1m"`
+}
+
+type OIDCProvider struct {
+	Issuer       string   `yaml:"issuer" env:"ISSUER"`
+	ClientID     string   `yaml:"client_id" env:"CLIENT_ID"`
+	ClientSecret string   `yaml:"client_secret" env:"CLIENT_SECRET"`
+	RedirectURL  string   `yaml:"redirect_url" env:"REDIRECT_URL"`
+	Scopes       []string `yaml:"scopes" env:"SCOPES"`
+}
+
+// LoginThrottle limits failed logins. Once a counter reaches its maximum the
+// key is locked for BaseLockout, doubling with every further failure up to
+// MaxLockout. Counters are forgotten after Window without failures.
+type LoginThrottle struct {
+	MaxAttemptsPerEmail int           `yaml:"max_attempts_per_email" env:"MAX_ATTEMPTS_PER_EMAIL" env-default:"5"`
+	MaxAttemptsPerIP    int           `yaml:"max_attempts_per_ip" env:"MAX_ATTEMPTS_PER_IP" env-default:"20"`
+	Window              time.Duration `yaml:"window" env:"WINDOW" env-default:"15m"`
+	BaseLockout         time.Duration `yaml:"base_lockout" env:"BASE_LOCKOUT" env-default:"30s"`
+	MaxLockout          time.Duration `yaml:"max_lockout" env:"MAX_LOCKOUT" env-default:"1h"`
+}
+
+// PasswordPolicy is enforced on registration only, so tightening it never
+// locks existing users out.
+type PasswordPolicy struct {
+	MinLength     int  `yaml:"min_length" env:"MIN_LENGTH" env-default:"8"`
+	RequireUpper  bool `yaml:"require_upper" env:"REQUIRE_UPPER" env-default:"false"`
+	RequireLower  bool `yaml:"require_lower" env:"REQUIRE_LOWER" env-default:"false"`
+	RequireDigit  bool `yaml:"require_digit" env:"REQUIRE_DIGIT" env-default:"false"`
+	RequireSymbol bool `yaml:"require_symbol" env:"REQUIRE_SYMBOL" env-default:"false"`
+}
+
+// DefaultPath is the configuration file read when neither the -config flag
+// nor CONFIG_PATH names another one. Unlike an explicit path it may be
+// missing, leaving the defaults and the environment.
+const DefaultPath = "config/default.yaml"
+
+// Load builds the configuration from the env-default tags, the YAML file at
+// path and the environment, in increasing priority, and validates it. An
+// empty path means CONFIG_PATH or DefaultPath. Variables from a .env file in
+// the working directory are used when the process does not have them.
+func Load(path string) (*Config, error) {
+	dotenv, err := godotenv.Read()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("ошибка загрузки файла .env: %w", err)
 	}
 
-	yamlFile, err := os.ReadFile(configPath)
-	if err != nil {
-		panic(fmt.Sprintf("не удалось прочитать конфигурационный файл: %v", err))
+	optional := false
+	if path == "" {
+		path = os.Getenv("CONFIG_PATH")
+	}
+	if path == "" {
+		path = dotenv["CONFIG_PATH"]
+	}
+	if path == "" {
+		path, optional = DefaultPath, true
 	}
 
 	var config Config
+	if err := applyDefaults(reflect.ValueOf(&config).Elem()); err != nil {
+		return nil, err
+	}
 
-	if err := yaml.Unmarshal(yamlFile, &config); err != nil {
-		panic(fmt.Sprintf("не удалось распарсить конфигурационный файл: %v", err))
+	yamlFile, err := os.ReadFile(path)
+	switch {
+	case optional && errors.Is(err, fs.ErrNotExist):
+	case errors.Is(err, fs.ErrNotExist):
+		return nil, fmt.Errorf("конфигурационный файл не существует: %s", path)
+	case err != nil:
+		return nil, fmt.Errorf("не удалось прочитать конфигурационный файл: %w", err)
+	default:
+		if err := yaml.Unmarshal(yamlFile, &config); err != nil {
+			return nil, fmt.Errorf("не удалось распарсить конфигурационный файл: %w", err)
+		}
 	}
 
-	return &config
+	if errs := applyEnv(reflect.ValueOf(&config).Elem(), "", dotenv); len(errs) > 0 {
+		return nil, fmt.Errorf("некорректные переменные окружения:\n%w", errors.Join(errs...))
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("некорректная конфигурация:\n%w", err)
+	}
+	return &config, nil
 }
@@ -0,0 +1,183 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fields are mapped to environment variables through struct tags:
+//
+//	env:"HOST"            variable name, prefixed by the env-prefix of every
+//	                      enclosing struct field (so Database.Host is DB_HOST)
+//	env-prefix:"DB_"      prefix for the fields of a nested struct; on a map
+//	                      of structs the key follows, e.g. AUTH_OIDC_<NAME>_
+//	env-default:"5432"    value used when neither the file nor the
+//	                      environment sets the field
+//
+// For every variable NAME, NAME_FILE may point to a file holding the value,
+// which is how Docker and Kubernetes secrets are usually mounted. The process
+// environment wins over a .env file, so a NAME_FILE passed to the container
+// is not shadowed by a NAME left in .env.
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// applyDefaults sets every field with an env-default tag.
+func applyDefaults(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f, fv := t.Field(i), v.Field(i)
+		if f.Type.Kind() == reflect.Struct {
+			if err := applyDefaults(fv); err != nil {
+				return err
+			}
+			continue
+		}
+		def, ok := f.Tag.Lookup("env-default")
+		if !ok {
+			continue
+		}
+		if err := setField(fv, def); err != nil {
+			return fmt.Errorf("default of %s: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// applyEnv overrides fields with the environment variables named by their
+// env tags and reports every value that could not be parsed.
+func applyEnv(v reflect.Value, prefix string, dotenv map[string]string) []error {
+	var errs []error
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f, fv := t.Field(i), v.Field(i)
+		switch {
+		case f.Type.Kind() == reflect.Struct:
+			errs = append(errs, applyEnv(fv, prefix+f.Tag.Get("env-prefix"), dotenv)...)
+			continue
+		case f.Type.Kind() == reflect.Map && f.Type.Elem().Kind() == reflect.Struct:
+			// Only entries declared in the file can be overridden, as there
+			// is no way to list the keys from the environment.
+			for _, key := range fv.MapKeys() {
+				elem := reflect.New(f.Type.Elem()).Elem()
+				elem.Set(fv.MapIndex(key))
+				name := prefix + f.Tag.Get("env-prefix") + envKey(key.String()) + "_"
+				errs = append(errs, applyEnv(elem, name, dotenv)...)
+				fv.SetMapIndex(key, elem)
+			}
+			continue
+		}
+
+		name := f.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		name = prefix + name
+		raw, ok, err := lookupEnv(name, dotenv)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if err := setField(fv, raw); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errs
+}
+
+// lookupEnv returns the value of name, or the contents of the file named by
+// name_FILE when name itself is not set, looking at the process environment
+// first and at dotenv second.
+func lookupEnv(name string, dotenv map[string]string) (string, bool, error) {
+	path := ""
+	for _, lookup := range []func(string) (string, bool){os.LookupEnv, mapLookup(dotenv)} {
+		if v, ok := lookup(name); ok {
+			return v, true, nil
+		}
+		if path, _ = lookup(name + "_FILE"); path != "" {
+			break
+		}
+	}
+	if path == "" {
+		return "", false, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("%s_FILE: %w", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+func mapLookup(m map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := m[key]
+		return v, ok
+	}
+}
+
+// envKey turns a map key such as "my-idp" into MY_IDP.
+func envKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+func setField(v reflect.Value, raw string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		var items []string
+		for _, s := range strings.Split(raw, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				items = append(items, s)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Validate reports every invalid setting at once, so a broken deployment
+// does not have to be fixed one restart at a time.
+func (c *Config) Validate() error {
+	var errs []error
+	add := func(field, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+	required := func(field, value string) {
+		if value == "" {
+			add(field, "обязательное поле")
+		}
+	}
+	port := func(field, value string) {
+		if n, err := strconv.Atoi(value); err != nil || n < 1 || n > 65535 {
+			add(field, "некорректный порт %q", value)
+		}
+	}
+	positive := func(field string, d time.Duration) {
+		if d <= 0 {
+			add(field, "должно быть больше нуля")
+		}
+	}
+
+	port("server.port", c.Server.Port)
+	positive("server.read_header_timeout", c.Server.ReadHeaderTimeout)
+	positive("server.read_timeout", c.Server.ReadTimeout)
+	positive("server.write_timeout", c.Server.WriteTimeout)
+	positive("server.idle_timeout", c.Server.IdleTimeout)
+	positive("server.shutdown_timeout", c.Server.ShutdownTimeout)
+	if c.Server.ShutdownDelay < 0 {
+		add("server.shutdown_delay", "не может быть отрицательным")
+	}
+	if u, err := url.Parse(c.Server.PublicURL); err != nil || u.Scheme == "" || u.Host == "" {
+		add("server.public_url", "ожидается абсолютный URL, получено %q", c.Server.PublicURL)
+	}
+	for _, origin := range c.Server.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			strings.TrimSuffix(u.Path, "/") != "" || u.RawQuery != "" || u.Fragment != "" {
+			add("server.allowed_origins", "ожидается origin вида https://example.com, получено %q", origin)
+		}
+	}
+
+	required("database.name", c.Database.Name)
+	required("database.user", c.Database.User)
+	required("database.host", c.Database.Host)
+	port("database.port", c.Database.Port)
+
+	switch c.State.Backend {
+	case "redis":
+		required("redis.host", c.Redis.Host)
+		port("redis.port", c.Redis.Port)
+		if c.Redis.DB < 0 {
+			add("redis.db", "не может быть отрицательным")
+		}
+	case "memory":
+	default:
+		add("state.backend", "неизвестный backend состояния %q, ожидается redis или memory", c.State.Backend)
+	}
+
+	required("storage.dir", c.Storage.Dir)
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout", "otlp":
+	default:
+		add("tracing.exporter", "неизвестный экспортёр %q, ожидается none, stdout или otlp", c.Tracing.Exporter)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		add("tracing.sample_ratio", "должно быть от 0 до 1")
+	}
+
+	nonNegative := func(field string, n int) {
+		if n < 0 {
+			add(field, "не может быть отрицательным")
+		}
+	}
+	rl := c.RateLimit
+	nonNegative("rate_limit.messages_per_user", rl.MessagesPerUser)
+	nonNegative("rate_limit.messages_per_ip", rl.MessagesPerIP)
+	nonNegative("rate_limit.attachments_per_user", rl.AttachmentsPerUser)
+	nonNegative("rate_limit.attachments_per_ip", rl.AttachmentsPerIP)
+	nonNegative("rate_limit.auth_per_user", rl.AuthPerUser)
+	nonNegative("rate_limit.auth_per_ip", rl.AuthPerIP)
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		add("log.level", "неизвестный уровень %q, ожидается debug, info, warn или error", c.Log.Level)
+	}
+	switch strings.ToLower(c.Log.Format) {
+	case "json", "text":
+	default:
+		add("log.format", "неизвестный формат %q, ожидается json или text", c.Log.Format)
+	}
+
+	switch c.Privacy.DeletionPolicy {
+	case "anonymize", "delete":
+	default:
+		add("privacy.deletion_policy", "неизвестная политика удаления %q, ожидается anonymize или delete", c.Privacy.DeletionPolicy)
+	}
+
+	if c.Mail.Host != "" {
+		port("mail.port", c.Mail.Port)
+		required("mail.from", c.Mail.From)
+	}
+
+	a := c.Auth
+	positive("auth.verification_token_ttl", a.VerificationTokenTTL)
+	positive("auth.mfa_token_ttl", a.MFATokenTTL)
+	required("auth.totp_issuer", a.TOTPIssuer)
+	if a.Password.MinLength < 1 {
+		add("auth.password.min_length", "должно быть больше нуля")
+	}
+
+	t := a.Throttle
+	if t.MaxAttemptsPerEmail < 1 {
+		add("auth.login_throttle.max_attempts_per_email", "должно быть больше нуля")
+	}
+	if t.MaxAttemptsPerIP < 1 {
+		add("auth.login_throttle.max_attempts_per_ip", "должно быть больше нуля")
+	}
+	positive("auth.login_throttle.window", t.Window)
+	positive("auth.login_throttle.base_lockout", t.BaseLockout)
+	positive("auth.login_throttle.max_lockout", t.MaxLockout)
+	if t.BaseLockout > t.MaxLockout {
+		add("auth.login_throttle.base_lockout", "не может превышать max_lockout")
+	}
+
+	if a.SigningKeys.Dir != "" {
+		positive("auth.signing_keys.reload_interval", a.SigningKeys.ReloadInterval)
+	}
+	for name, p := range a.OIDCProviders {
+		field := "auth.oidc_providers." + name
+		required(field+".issuer", p.Issuer)
+		required(field+".client_id", p.ClientID)
+		required(field+".redirect_url", p.RedirectURL)
+	}
+
+	return errors.Join(errs...)
+}
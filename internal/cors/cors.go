@@ -0,0 +1,117 @@
+// Package cors decides which browser origins may use the API: it answers
+// CORS preflights, adds the CORS headers to responses and checks the Origin
+// of WebSocket handshakes.
+package cors
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Methods and headers allowed cross-origin. Authentication is by bearer
+// token, so credentials (cookies) are never allowed.
+const (
+	allowedMethods  = "GET, POST, PUT, PATCH, DELETE"
+	allowedHeaders  = "Authorization, Content-Type, X-Request-ID"
+	exposedHeaders  = "Retry-After, X-Request-ID"
+	preflightMaxAge = 10 * time.Minute
+)
+
+// Policy is the set of allowed origins.
+type Policy struct {
+	origins map[string]bool
+	any     bool
+}
+
+// New allows origins, given as URLs of which only the scheme and host are
+// used; "*" allows any origin.
+func New(origins ...string) *Policy {
+	p := &Policy{origins: make(map[string]bool)}
+	for _, o := range origins {
+		if o == "*" {
+			p.any = true
+			continue
+		}
+		if o = normalize(o); o != "" {
+			p.origins[o] = true
+		}
+	}
+	return p
+}
+
+// normalize returns the scheme://host form of origin, or "" if it has none.
+func normalize(origin string) string {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+// Allowed reports whether origin, the value of an Origin header, may use
+// the API.
+func (p *Policy) Allowed(origin string) bool {
+	if p.any {
+		return true
+	}
+	return p.origins[normalize(origin)]
+}
+
+// CheckOrigin is the websocket.Upgrader hook. Handshakes without an Origin
+// header do not come from browsers and are allowed, as are those from the
+// origin the request was sent to; any other origin must be allowed, so that
+// a foreign page cannot open a socket with the user's credentials.
+func (p *Policy) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || p.Allowed(origin) {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	slog.InfoContext(r.Context(), "WebSocket: origin not allowed", "origin", origin)
+	return false
+}
+
+// Middleware adds the CORS headers for allowed origins and answers
+// preflight requests itself. Requests from other origins are served without
+// CORS headers, so browsers do not expose the responses.
+func (p *Policy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+		}
+		allowed := p.Allowed(origin)
+		if allowed {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if !preflight {
+			if allowed {
+				h.Set("Access-Control-Expose-Headers", exposedHeaders)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if allowed {
+			h.Set("Access-Control-Allow-Methods", allowedMethods)
+			h.Set("Access-Control-Allow-Headers", allowedHeaders)
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(preflightMaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,133 @@
+// Package health serves the liveness and readiness probes.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StatusOK           = "ok"
+	StatusUnavailable  = "unavailable"
+	StatusShuttingDown = "shutting_down"
+)
+
+// checkTimeout bounds every dependency check of one readiness probe.
+const checkTimeout = 2 * time.Second
+
+// Check reports whether a dependency is usable.
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker runs the registered dependency checks for /readyz.
+type Checker struct {
+	checks   []namedCheck
+	draining atomic.Bool
+}
+
+func NewChecker() *Checker {
+	return &Checker{}
+}
+
+// Add registers a dependency check. It must be called before serving.
+func (c *Checker) Add(name string, check Check) {
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+// SetDraining makes /readyz fail from now on, so that load balancers stop
+// routing new clients to an instance that is shutting down.
+func (c *Checker) SetDraining() {
+	c.draining.Store(true)
+}
+
+// CheckResult is the outcome of one dependency check. Errors are only
+// logged, as probes are reachable without authentication.
+type CheckResult struct {
+	Status     string `json:"status"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// Run executes every check concurrently.
+func (c *Checker) Run(ctx context.Context) Report {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]CheckResult, len(c.checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, nc := range c.checks {
+		wg.Add(1)
+		go func(nc namedCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := nc.check(ctx)
+			res := CheckResult{Status: StatusOK, DurationMs: time.Since(start).Milliseconds()}
+			if err != nil {
+				slog.WarnContext(ctx, "Readiness check failed", "check", nc.name, "error", err)
+				res.Status = StatusUnavailable
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[nc.name] = res
+			if err != nil {
+				report.Status = StatusUnavailable
+			}
+		}(nc)
+	}
+	wg.Wait()
+	return report
+}
+
+// @Summary Liveness probe
+// @Description Отвечает 200, пока процесс жив. Зависимости не проверяются.
+// @Tags health
+// @Produce json
+// @Success 200 {object} Report
+// @Router /healthz [get]
+func (c *Checker) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, http.StatusOK, Report{Status: StatusOK})
+}
+
+// @Summary Readiness probe
+// @Description Проверяет PostgreSQL, Redis, запись в хранилище файлов и версию схемы БД.
+// @Description Отвечает 503 с разбивкой по зависимостям, если какая-то недоступна,
+// @Description и со статусом shutting_down во время остановки сервера.
+// @Tags health
+// @Produce json
+// @Success 200 {object} Report
+// @Failure 503 {object} Report
+// @Router /readyz [get]
+func (c *Checker) Readyz(w http.ResponseWriter, r *http.Request) {
+	if c.draining.Load() {
+		writeReport(w, http.StatusServiceUnavailable, Report{Status: StatusShuttingDown})
+		return
+	}
+	report := c.Run(r.Context())
+	code := http.StatusOK
+	if report.Status != StatusOK {
+		code = http.StatusServiceUnavailable
+	}
+	writeReport(w, code, report)
+}
+
+func writeReport(w http.ResponseWriter, code int, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(report)
+}
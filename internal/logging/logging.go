@@ -0,0 +1,127 @@
+// Package logging configures log/slog: JSON or text output, the level from
+// the config, request and user ids taken from the context, and redaction of
+// secrets and message bodies.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"RealtimeChat/internal/config"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader carries the request id; a valid incoming value is kept so
+// that ids assigned by a proxy can be followed through.
+const RequestIDHeader = "X-Request-ID"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Setup installs the logger described by cfg as the slog default, which also
+// routes the standard log package through it.
+func Setup(cfg config.Log) (*slog.Logger, error) {
+	logger, err := New(os.Stderr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(logger)
+	return logger, nil
+}
+
+func New(w io.Writer, cfg config.Log) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", cfg.Level)
+	}
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+
+	var h slog.Handler
+	switch strings.ToLower(cfg.Format) {
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q", cfg.Format)
+	}
+	return slog.New(contextHandler{h}), nil
+}
+
+type ctxKey struct{}
+
+// requestInfo is shared by everything logging for one request. The user id
+// is filled in by the auth middleware, after the request id was assigned.
+type requestInfo struct {
+	id     string
+	mu     sync.Mutex
+	userID string
+}
+
+// Middleware assigns every request an id, returns it in X-Request-ID and
+// makes it part of every record logged with the request context.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		ctx := context.WithValue(r.Context(), ctxKey{}, &requestInfo{id: id})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// SetUserID records the authenticated user of the request in ctx.
+func SetUserID(ctx context.Context, userID string) {
+	if info, ok := ctx.Value(ctxKey{}).(*requestInfo); ok {
+		info.mu.Lock()
+		info.userID = userID
+		info.mu.Unlock()
+	}
+}
+
+// RequestID returns the id assigned by Middleware, or "".
+func RequestID(ctx context.Context) string {
+	if info, ok := ctx.Value(ctxKey{}).(*requestInfo); ok {
+		return info.id
+	}
+	return ""
+}
+
+// contextHandler adds request_id, user_id, trace_id and span_id from the
+// context to records.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if info, ok := ctx.Value(ctxKey{}).(*requestInfo); ok {
+		r.AddAttrs(slog.String("request_id", info.id))
+		info.mu.Lock()
+		userID := info.userID
+		info.mu.Unlock()
+		if userID != "" {
+			r.AddAttrs(slog.String("user_id", userID))
+		}
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
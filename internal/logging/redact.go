@@ -0,0 +1,83 @@
+package logging
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// Attributes whose key contains one of these are never logged.
+var sensitiveKeyParts = []string{
+	"password", "passwd", "secret", "token", "authorization", "cookie", "api_key", "apikey",
+}
+
+// Attributes with these exact keys carry what users wrote or were sent.
+var sensitiveKeys = map[string]bool{
+	"content": true,
+	"body":    true,
+	"text":    true,
+	"code":    true,
+	"otp":     true,
+}
+
+// Secrets that may end up inside messages or error strings.
+var secretPatterns = []*regexp.Regexp{
+	// Bearer credentials of any kind.
+	regexp.MustCompile(`(?i)\bbearer\s+[^\s"',]+`),
+	// JWTs: base64url header and payload, both starting with '{"'.
+	regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{4,}\.eyJ[A-Za-z0-9_-]{4,}\.[A-Za-z0-9_-]*`),
+	// API tokens, see shared.APITokenPrefix.
+	regexp.MustCompile(`\brtc_[A-Za-z0-9_-]{8,}`),
+	// One-time tokens and credentials in URLs.
+	regexp.MustCompile(`(?i)\b((?:token|ticket|code|state|password|secret)=)[^&\s"']+`),
+}
+
+// redactAttr is the ReplaceAttr hook of the handlers: it drops sensitive
+// attributes by key and scrubs secrets out of every other string, including
+// the message and errors.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if isSensitiveKey(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Scrub(v.String()))
+	case slog.KindAny:
+		switch x := v.Any().(type) {
+		case error:
+			return slog.String(a.Key, Scrub(x.Error()))
+		case []byte:
+			return slog.String(a.Key, Scrub(string(x)))
+		}
+	}
+	return a
+}
+
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	if sensitiveKeys[key] {
+		return true
+	}
+	for _, part := range sensitiveKeyParts {
+		if strings.Contains(key, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// Scrub replaces the secrets recognised in s.
+func Scrub(s string) string {
+	for _, re := range secretPatterns {
+		if re.NumSubexp() > 0 {
+			s = re.ReplaceAllString(s, "${1}"+redacted)
+		} else {
+			s = re.ReplaceAllString(s, redacted)
+		}
+	}
+	return s
+}
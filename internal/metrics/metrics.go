@@ -0,0 +1,123 @@
+// Package metrics defines the Prometheus metrics of the service. They are
+// registered with the default registry, which also carries the Go runtime
+// and process collectors, and served by Handler.
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+)
+
+const namespace = "realtimechat"
+
+// Message types of MessagesSent.
+const (
+	MessagePublic     = "public"
+	MessagePrivate    = "private"
+	MessageAttachment = "attachment"
+)
+
+// Fan-out kinds of FanoutDuration.
+const (
+	FanoutBroadcast = "broadcast"
+	FanoutDirect    = "direct"
+)
+
+var (
+	MessagesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_sent_total",
+		Help:      "Messages saved, by type (public, private, attachment).",
+	}, []string{"type"})
+
+	FanoutDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "fanout_duration_seconds",
+		Help:      "Time to deliver one event to the local WebSocket clients.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"kind"})
+
+	WebSocketWriteFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_write_failures_total",
+		Help:      "Events that could not be written to a WebSocket client.",
+	})
+
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Requests and WebSocket messages rejected by a rate limit, by budget.",
+	}, []string{"budget"})
+
+	redisErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redis_errors_total",
+		Help:      "Failed Redis commands, by command. Missing keys and cancelled calls are not errors.",
+	}, []string{"command"})
+)
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// RegisterWebSocketConnections exports count as the number of open
+// WebSocket connections.
+func RegisterWebSocketConnections(count func() int) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "websocket_connections",
+		Help:      "Open WebSocket connections on this instance.",
+	}, func() float64 { return float64(count()) }))
+}
+
+// RegisterDB exports the connection pool statistics of db.
+func RegisterDB(db *sql.DB) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, "postgres"))
+}
+
+// RedisHook counts failed Redis commands; add it with redis.Client.AddHook.
+type RedisHook struct{}
+
+func (RedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := next(ctx, network, addr)
+		if err != nil {
+			redisErrors.WithLabelValues("dial").Inc()
+		}
+		return conn, err
+	}
+}
+
+func (RedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		countRedisError(cmd, err)
+		return err
+	}
+}
+
+func (RedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		err := next(ctx, cmds)
+		for _, cmd := range cmds {
+			countRedisError(cmd, cmd.Err())
+		}
+		return err
+	}
+}
+
+func countRedisError(cmd redis.Cmder, err error) {
+	if err != nil && !errors.Is(err, redis.Nil) && !errors.Is(err, context.Canceled) {
+		redisErrors.WithLabelValues(cmd.Name()).Inc()
+	}
+}
@@ -0,0 +1,304 @@
+// Package migrate applies the SQL migrations embedded in the binary.
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// lockID is the key of the advisory lock that serializes concurrent
+// replicas running migrations against the same database.
+const lockID int64 = 7243108501
+
+var fileName = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// Migration is one schema version.
+type Migration struct {
+	Version  int64
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// Status describes a migration and whether it was applied.
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+type Runner struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// New reads the migrations in fsys. Every version needs an up file; down
+// files are optional but required to roll the version back.
+func New(db *sql.DB, fsys fs.FS) (*Runner, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, e := range entries {
+		m := fileName.FindStringSubmatch(e.Name())
+		if e.IsDir() || m == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %v", e.Name(), err)
+		}
+		data, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		mig := byVersion[version]
+		if mig == nil {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration version %d is used by both %q and %q", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(data)
+			sum := sha256.Sum256(data)
+			mig.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			mig.Down = string(data)
+		}
+	}
+
+	r := &Runner{db: db}
+	for _, mig := range byVersion {
+		if mig.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", mig.Version, mig.Name)
+		}
+		r.migrations = append(r.migrations, *mig)
+	}
+	sort.Slice(r.migrations, func(i, j int) bool { return r.migrations[i].Version < r.migrations[j].Version })
+	return r, nil
+}
+
+type applied struct {
+	checksum  string
+	appliedAt time.Time
+}
+
+// session runs fn on a single connection holding the advisory lock, after
+// making sure schema_migrations exists.
+func (r *Runner) session(ctx context.Context, fn func(conn *sql.Conn, done map[int64]applied) error) error {
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockID); err != nil {
+		return fmt.Errorf("failed to take migration lock: %v", err)
+	}
+	defer func() {
+		// The connection may be unusable if ctx was cancelled; closing it
+		// releases the lock anyway.
+		if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockID); err != nil {
+			slog.Error("Failed to release migration lock", "error", err)
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS schema_migrations
+        (
+            version    BIGINT PRIMARY KEY,
+            name       VARCHAR(255) NOT NULL,
+            checksum   VARCHAR(64)  NOT NULL,
+            applied_at TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP
+        )
+    `)
+	if err != nil {
+		return err
+	}
+
+	rows, err := conn.QueryContext(ctx, `SELECT version, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	done := make(map[int64]applied)
+	for rows.Next() {
+		var version int64
+		var a applied
+		if err := rows.Scan(&version, &a.checksum, &a.appliedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		done[version] = a
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return fn(conn, done)
+}
+
+// verify fails when an applied migration was edited afterwards or is no
+// longer known to this binary.
+func (r *Runner) verify(done map[int64]applied) error {
+	known := make(map[int64]bool, len(r.migrations))
+	for _, m := range r.migrations {
+		known[m.Version] = true
+		if a, ok := done[m.Version]; ok && a.checksum != m.Checksum {
+			return fmt.Errorf("migration %d_%s was modified after it was applied (checksum %s, applied %s)",
+				m.Version, m.Name, m.Checksum, a.checksum)
+		}
+	}
+	for version := range done {
+		if !known[version] {
+			return fmt.Errorf("database has migration %d applied, which this binary does not know; is it outdated?", version)
+		}
+	}
+	return nil
+}
+
+// Up applies all pending migrations in order, each in its own transaction,
+// and returns how many were applied.
+func (r *Runner) Up(ctx context.Context) (int, error) {
+	var n int
+	err := r.session(ctx, func(conn *sql.Conn, done map[int64]applied) error {
+		if err := r.verify(done); err != nil {
+			return err
+		}
+		for _, m := range r.migrations {
+			if _, ok := done[m.Version]; ok {
+				continue
+			}
+			err := inTx(ctx, conn, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, m.Up); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx,
+					`INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)`,
+					m.Version, m.Name, m.Checksum,
+				)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d_%s failed: %v", m.Version, m.Name, err)
+			}
+			slog.Info("Applied migration", "version", m.Version, "name", m.Name)
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Down rolls back the last steps applied migrations, newest first.
+func (r *Runner) Down(ctx context.Context, steps int) (int, error) {
+	var n int
+	err := r.session(ctx, func(conn *sql.Conn, done map[int64]applied) error {
+		if err := r.verify(done); err != nil {
+			return err
+		}
+		for i := len(r.migrations) - 1; i >= 0 && n < steps; i-- {
+			m := r.migrations[i]
+			if _, ok := done[m.Version]; !ok {
+				continue
+			}
+			if m.Down == "" {
+				return fmt.Errorf("migration %d_%s has no down file", m.Version, m.Name)
+			}
+			err := inTx(ctx, conn, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, m.Down); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, m.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("rollback of %d_%s failed: %v", m.Version, m.Name, err)
+			}
+			slog.Info("Rolled back migration", "version", m.Version, "name", m.Name)
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Status lists every known migration with the time it was applied.
+func (r *Runner) Status(ctx context.Context) ([]Status, error) {
+	var res []Status
+	err := r.session(ctx, func(conn *sql.Conn, done map[int64]applied) error {
+		for _, m := range r.migrations {
+			s := Status{Migration: m}
+			if a, ok := done[m.Version]; ok {
+				appliedAt := a.appliedAt
+				s.AppliedAt = &appliedAt
+			}
+			res = append(res, s)
+		}
+		return r.verify(done)
+	})
+	return res, err
+}
+
+// Check reports an error unless the database schema is exactly the latest
+// known version. Unlike the other methods it neither takes the lock nor
+// creates schema_migrations, so it is cheap enough for readiness probes.
+func (r *Runner) Check(ctx context.Context) error {
+	rows, err := r.db.QueryContext(ctx, `SELECT version, checksum FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	done := make(map[int64]applied)
+	for rows.Next() {
+		var version int64
+		var a applied
+		if err := rows.Scan(&version, &a.checksum); err != nil {
+			rows.Close()
+			return err
+		}
+		done[version] = a
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if err := r.verify(done); err != nil {
+		return err
+	}
+	var pending int
+	for _, m := range r.migrations {
+		if _, ok := done[m.Version]; !ok {
+			pending++
+		}
+	}
+	if pending > 0 {
+		return fmt.Errorf("%d pending migration(s)", pending)
+	}
+	return nil
+}
+
+func inTx(ctx context.Context, conn *sql.Conn, fn func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
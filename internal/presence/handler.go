@@ -0,0 +1,185 @@
+package presence
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	maxLookupIDs        = 100
+	maxStatusTextLength = 100
+)
+
+type Handler struct {
+	service *Service
+}
+
+func NewHandler(service *Service) *Handler {
+	return &Handler{service: service}
+}
+
+func userIDFromRequest(r *http.Request) (string, bool) {
+	claims, ok := r.Context().Value("userClaims").(jwt.MapClaims)
+	if !ok {
+		return "", false
+	}
+	userID := fmt.Sprintf("%v", claims["user_id"])
+	if userID == "" || userID == "<nil>" {
+		return "", false
+	}
+	return userID, true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// @Summary Присутствие пользователей
+// @Description Состояние (online, away, dnd, offline), пользовательский статус и время последнего визита
+// @Description для списка пользователей. Невидимые пользователи и заблокированные выглядят как offline,
+// @Description last_seen_at показывается согласно настройкам приватности пользователя.
+// @Tags presence
+// @Produce json
+// @Security BearerAuth
+// @Param ids query string true "Comma-separated user IDs (up to 100)"
+// @Success 200 {array} Presence
+// @Failure 400 {string} string "Invalid ids"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Insufficient scope"
+// @Router /presence [get]
+func (h *Handler) Presence(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	viewerID, ok := userIDFromRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var ids []string
+	seen := make(map[string]bool)
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		id = strings.TrimSpace(id)
+		if id == "" || seen[id] {
+			continue
+		}
+		if _, err := uuid.Parse(id); err != nil {
+			http.Error(w, "Invalid user id: "+id, http.StatusBadRequest)
+			return
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		http.Error(w, "ids is required", http.StatusBadRequest)
+		return
+	}
+	if len(ids) > maxLookupIDs {
+		http.Error(w, fmt.Sprintf("At most %d ids are allowed", maxLookupIDs), http.StatusBadRequest)
+		return
+	}
+
+	list, err := h.service.Lookup(r.Context(), viewerID, ids)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to look up presence", "error", err)
+		http.Error(w, "Failed to load presence", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, list)
+}
+
+// @Summary Мои настройки присутствия
+// @Description GET возвращает настройки, PATCH меняет состояние (online, away, dnd, invisible),
+// @Description пользовательский статус со сроком действия (пустой status_text сбрасывает статус)
+// @Description и видимость времени последнего визита (everyone, contacts, nobody)
+// @Tags presence
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body SettingsUpdate false "Fields to update (PATCH)"
+// @Success 200 {object} Settings
+// @Failure 400 {string} string "Invalid request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "API tokens are not allowed"
+// @Router /me/presence [get]
+// @Router /me/presence [patch]
+func (h *Handler) Settings(w http.ResponseWriter, r *http.Request) {
+	userID, ok := userIDFromRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var (
+		settings *Settings
+		err      error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		settings, err = h.service.GetSettings(r.Context(), userID)
+	case http.MethodPatch:
+		var upd SettingsUpdate
+		if err := json.NewDecoder(r.Body).Decode(&upd); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if msg := validateSettingsUpdate(&upd); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		settings, err = h.service.UpdateSettings(r.Context(), userID, upd)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if errors.Is(err, ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to handle presence settings", "error", err)
+		http.Error(w, "Failed to load presence settings", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, settings)
+}
+
+func validateSettingsUpdate(upd *SettingsUpdate) string {
+	if upd.State != nil {
+		switch *upd.State {
+		case StateOnline, StateAway, StateDND, StateInvisible:
+		default:
+			return "state must be one of online, away, dnd, invisible"
+		}
+	}
+	if upd.StatusText != nil {
+		text := strings.TrimSpace(*upd.StatusText)
+		if utf8.RuneCountInString(text) > maxStatusTextLength {
+			return fmt.Sprintf("status_text must be at most %d characters", maxStatusTextLength)
+		}
+		upd.StatusText = &text
+	}
+	if upd.StatusExpiresAt != nil && !upd.StatusExpiresAt.After(time.Now()) {
+		return "status_expires_at must be in the future"
+	}
+	if upd.LastSeenVisibility != nil {
+		switch *upd.LastSeenVisibility {
+		case VisibilityEveryone, VisibilityContacts, VisibilityNobody:
+		default:
+			return "last_seen_visibility must be one of everyone, contacts, nobody"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,395 @@
+package presence
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+
+	"RealtimeChat/internal/shared"
+	"github.com/lib/pq"
+)
+
+// Presence states. Offline is never stored: a user is offline when their
+// heartbeat expired, and invisible users look offline to everybody else.
+const (
+	StateOnline    = "online"
+	StateAway      = "away"
+	StateDND       = "dnd"
+	StateInvisible = "invisible"
+	StateOffline   = "offline"
+)
+
+// Who may see the last seen time of a user.
+const (
+	VisibilityEveryone = "everyone"
+	VisibilityContacts = "contacts"
+	VisibilityNobody   = "nobody"
+)
+
+var ErrUserNotFound = errors.New("user not found")
+
+type Service struct {
+	db     *shared.DB
+	store  shared.PresenceStore
+	pubsub shared.PubSub
+}
+
+func NewService(db *shared.DB, store shared.PresenceStore, pubsub shared.PubSub) *Service {
+	return &Service{db: db, store: store, pubsub: pubsub}
+}
+
+// CustomStatus is a short user-set text shown next to the presence state.
+type CustomStatus struct {
+	Text      string     `json:"text" example:"В отпуске"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Presence is what a viewer is allowed to see about a user.
+type Presence struct {
+	UserID     string        `json:"user_id"`
+	State      string        `json:"state" example:"online"`
+	Status     *CustomStatus `json:"status,omitempty"`
+	LastSeenAt *time.Time    `json:"last_seen_at,omitempty"`
+}
+
+// Online reports whether the user appears connected.
+func (p *Presence) Online() bool {
+	return p.State != StateOffline
+}
+
+// Settings are the presence preferences of the authenticated user.
+type Settings struct {
+	State              string        `json:"state" example:"online"`
+	Status             *CustomStatus `json:"status,omitempty"`
+	LastSeenVisibility string        `json:"last_seen_visibility" example:"everyone"`
+}
+
+// SettingsUpdate holds the fields of a PATCH; nil leaves a field unchanged.
+// An empty status_text clears the custom status.
+type SettingsUpdate struct {
+	State              *string    `json:"state"`
+	StatusText         *string    `json:"status_text"`
+	StatusExpiresAt    *time.Time `json:"status_expires_at"`
+	LastSeenVisibility *string    `json:"last_seen_visibility"`
+}
+
+func customStatus(text *string, expiresAt *time.Time, now time.Time) *CustomStatus {
+	if text == nil || *text == "" || (expiresAt != nil && !expiresAt.After(now)) {
+		return nil
+	}
+	return &CustomStatus{Text: *text, ExpiresAt: expiresAt}
+}
+
+func (s *Service) GetSettings(ctx context.Context, userID string) (*Settings, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var settings Settings
+	var text *string
+	var expiresAt *time.Time
+	err := s.db.QueryRowContext(ctx,
+		`SELECT presence_state, status_text, status_expires_at, last_seen_visibility FROM users WHERE id = $1`,
+		userID,
+	).Scan(&settings.State, &text, &expiresAt, &settings.LastSeenVisibility)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	settings.Status = customStatus(text, expiresAt, time.Now())
+	return &settings, nil
+}
+
+func (s *Service) UpdateSettings(ctx context.Context, userID string, upd SettingsUpdate) (*Settings, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// A new status text replaces the expiry as well, so an old expiry does
+	// not carry over to a status set without one.
+	query := `
+        UPDATE users SET
+            presence_state       = COALESCE($2, presence_state),
+            status_text          = CASE WHEN $3::text IS NULL THEN status_text ELSE NULLIF($3, '') END,
+            status_expires_at    = CASE WHEN $3::text IS NULL THEN COALESCE($4, status_expires_at)
+                                        WHEN $3 = '' THEN NULL ELSE $4 END,
+            last_seen_visibility = COALESCE($5, last_seen_visibility),
+            updated_at           = NOW()
+        WHERE id = $1
+    `
+	res, err := s.db.ExecContext(ctx, query, userID, upd.State, upd.StatusText, upd.StatusExpiresAt, upd.LastSeenVisibility)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, ErrUserNotFound
+	}
+	if err := s.pubsub.Publish(ctx, shared.PresenceChannel, userID); err != nil {
+		slog.ErrorContext(ctx, "Failed to publish presence change", "error", err)
+	}
+	return s.GetSettings(ctx, userID)
+}
+
+// Get returns the presence of a single user as seen by viewerID.
+func (s *Service) Get(ctx context.Context, viewerID, userID string) (*Presence, error) {
+	list, err := s.Lookup(ctx, viewerID, []string{userID})
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return &Presence{UserID: userID, State: StateOffline}, nil
+	}
+	return &list[0], nil
+}
+
+// Lookup returns the presence of users as seen by viewerID, in no
+// particular order. Unknown ids are left out. Users who blocked each other
+// with the viewer always appear offline, invisible users appear offline to
+// everybody but themselves, and last seen follows the user's visibility
+// setting: "contacts" are users they have a direct conversation with.
+func (s *Service) Lookup(ctx context.Context, viewerID string, userIDs []string) ([]Presence, error) {
+	if len(userIDs) == 0 {
+		return []Presence{}, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+        SELECT u.id, u.presence_state, u.status_text, u.status_expires_at, u.last_seen_at, u.last_seen_visibility,
+               EXISTS (
+                    SELECT 1 FROM user_blocks b
+                    WHERE b.kind = 'block'
+                      AND ((b.blocker_id = $1 AND b.blocked_id = u.id) OR (b.blocker_id = u.id AND b.blocked_id = $1))
+               ),
+               EXISTS (
+                    SELECT 1 FROM messages m
+                    WHERE (m.user_id = $1 AND m.recipient_user_id = u.id)
+                       OR (m.user_id = u.id AND m.recipient_user_id = $1)
+               )
+        FROM users u
+        WHERE u.id = ANY($2::uuid[]) AND u.deleted_at IS NULL
+    `
+	rows, err := s.db.QueryContext(ctx, query, viewerID, pq.Array(userIDs))
+	if err != nil {
+		return nil, err
+	}
+	users, err := scanPresenceRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(users))
+	for i, u := range users {
+		ids[i] = u.userID
+	}
+	online, lastSeen := s.liveState(ctx, ids)
+
+	now := time.Now()
+	res := make([]Presence, 0, len(users))
+	for _, u := range users {
+		res = append(res, u.seenBy(viewerID, online, lastSeen, now))
+	}
+	return res, nil
+}
+
+// LookupWatchers returns the presence of userID as seen by each of
+// viewerIDs, with the rules of Lookup but in a single query. A deleted or
+// unknown user is offline to everybody.
+func (s *Service) LookupWatchers(ctx context.Context, userID string, viewerIDs []string) (map[string]Presence, error) {
+	res := make(map[string]Presence, len(viewerIDs))
+	if len(viewerIDs) == 0 {
+		return res, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+        SELECT v.id, u.presence_state, u.status_text, u.status_expires_at, u.last_seen_at, u.last_seen_visibility,
+               EXISTS (
+                    SELECT 1 FROM user_blocks b
+                    WHERE b.kind = 'block'
+                      AND ((b.blocker_id = v.id AND b.blocked_id = u.id) OR (b.blocker_id = u.id AND b.blocked_id = v.id))
+               ),
+               EXISTS (
+                    SELECT 1 FROM messages m
+                    WHERE (m.user_id = v.id AND m.recipient_user_id = u.id)
+                       OR (m.user_id = u.id AND m.recipient_user_id = v.id)
+               )
+        FROM users u CROSS JOIN unnest($2::uuid[]) AS v(id)
+        WHERE u.id = $1 AND u.deleted_at IS NULL
+    `
+	rows, err := s.db.QueryContext(ctx, query, userID, pq.Array(viewerIDs))
+	if err != nil {
+		return nil, err
+	}
+	// The first column is the viewer here; every row is about userID.
+	viewers, err := scanPresenceRows(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range viewerIDs {
+		res[id] = Presence{UserID: userID, State: StateOffline}
+	}
+	if len(viewers) == 0 {
+		return res, nil
+	}
+
+	online, lastSeen := s.liveState(ctx, []string{userID})
+	now := time.Now()
+	for _, v := range viewers {
+		viewerID := v.userID
+		v.userID = userID
+		res[viewerID] = v.seenBy(viewerID, online, lastSeen, now)
+	}
+	return res, nil
+}
+
+// presenceRow is what the database knows about the presence of a user and
+// their relation to one viewer.
+type presenceRow struct {
+	userID     string
+	pref       string
+	statusText *string
+	statusExp  *time.Time
+	lastSeen   *time.Time
+	visibility string
+	blocked    bool
+	contact    bool
+}
+
+func scanPresenceRows(rows *sql.Rows) ([]presenceRow, error) {
+	defer rows.Close()
+	var res []presenceRow
+	for rows.Next() {
+		var r presenceRow
+		err := rows.Scan(&r.userID, &r.pref, &r.statusText, &r.statusExp, &r.lastSeen, &r.visibility, &r.blocked, &r.contact)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res, rows.Err()
+}
+
+// liveState loads whether userIDs are connected and when they were last
+// seen from the presence store. Without the store everybody looks offline,
+// with the last seen time from the database.
+func (s *Service) liveState(ctx context.Context, userIDs []string) (map[string]bool, map[string]time.Time) {
+	online, err := s.store.AreUsersOnline(ctx, userIDs)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to load online status", "error", err)
+	}
+	lastSeen, err := s.store.LastSeen(ctx, userIDs)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to load last seen times", "error", err)
+	}
+	return online, lastSeen
+}
+
+// seenBy applies the visibility rules of Lookup for viewerID.
+func (r *presenceRow) seenBy(viewerID string, online map[string]bool, lastSeen map[string]time.Time, now time.Time) Presence {
+	p := Presence{UserID: r.userID, State: StateOffline}
+	if r.blocked && p.UserID != viewerID {
+		return p
+	}
+	self := p.UserID == viewerID
+
+	if online[p.UserID] {
+		p.State = r.pref
+		if r.pref == StateInvisible && !self {
+			p.State = StateOffline
+		}
+	}
+	if r.pref != StateInvisible || self {
+		p.Status = customStatus(r.statusText, r.statusExp, now)
+	}
+
+	seen := r.lastSeen
+	if t, ok := lastSeen[p.UserID]; ok && (seen == nil || t.After(*seen)) {
+		seen = &t
+	}
+	if self || (p.State == StateOffline && r.pref != StateInvisible && lastSeenVisible(r.visibility, r.contact)) {
+		p.LastSeenAt = seen
+	}
+	return p
+}
+
+// Watch calls fn with the id of every user whose presence changed on any
+// instance: on connect, on disconnect, when their heartbeat expires and
+// when they change their presence settings. The context passed to fn carries
+// the trace of the change, if any. It returns when ctx is cancelled.
+func (s *Service) Watch(ctx context.Context, fn func(ctx context.Context, userID string)) {
+	go s.store.WatchExpired(ctx, fn)
+	s.pubsub.Subscribe(ctx, shared.PresenceChannel, fn)
+}
+
+func lastSeenVisible(visibility string, contact bool) bool {
+	switch visibility {
+	case VisibilityEveryone:
+		return true
+	case VisibilityContacts:
+		return contact
+	default:
+		return false
+	}
+}
+
+// PersistLastSeen periodically copies the last seen times recorded by
+// shared.SetUserOnline from the presence store to users.last_seen_at until ctx is
+// cancelled, flushing once more on the way out.
+func (s *Service) PersistLastSeen(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.persistLastSeen(context.Background())
+			return
+		case <-ticker.C:
+		}
+		s.persistLastSeen(ctx)
+	}
+}
+
+func (s *Service) persistLastSeen(ctx context.Context) {
+	for {
+		n, err := s.flushLastSeen(ctx, 500)
+		if err != nil {
+			slog.Error("Failed to persist last seen times", "error", err)
+			return
+		}
+		if n < 500 {
+			return
+		}
+	}
+}
+
+func (s *Service) flushLastSeen(ctx context.Context, batch int) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	seen, err := s.store.PopLastSeen(ctx, batch)
+	if err != nil || len(seen) == 0 {
+		return 0, err
+	}
+	ids := make([]string, 0, len(seen))
+	times := make([]int64, 0, len(seen))
+	for id, t := range seen {
+		ids = append(ids, id)
+		times = append(times, t.Unix())
+	}
+
+	query := `
+        UPDATE users u SET last_seen_at = to_timestamp(v.ts)::timestamp
+        FROM unnest($1::uuid[], $2::bigint[]) AS v(id, ts)
+        WHERE u.id = v.id AND (u.last_seen_at IS NULL OR u.last_seen_at < to_timestamp(v.ts)::timestamp)
+    `
+	// On failure the times stay in the store, so Lookup still sees them;
+	// the next heartbeat of each user queues them again.
+	if _, err := s.db.ExecContext(ctx, query, pq.Array(ids), pq.Array(times)); err != nil {
+		return 0, err
+	}
+	return len(seen), nil
+}
@@ -0,0 +1,115 @@
+// Package ratelimit limits how fast users and IPs may send messages, upload
+// attachments and call the auth endpoints, with token buckets kept in the
+// state backend.
+package ratelimit
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"RealtimeChat/internal/config"
+	"RealtimeChat/internal/metrics"
+	"RealtimeChat/internal/shared"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Budget is a class of requests limited together.
+type Budget string
+
+const (
+	Messages    Budget = "messages"
+	Attachments Budget = "attachments"
+	Auth        Budget = "auth"
+)
+
+// period is the time over which the configured number of requests is
+// allowed.
+const period = time.Minute
+
+type Limiter struct {
+	enabled bool
+	store   shared.RateLimitStore
+	// local takes over while store fails, so an unreachable Redis limits
+	// each instance on its own instead of not at all.
+	local   *shared.MemoryRateLimitStore
+	perUser map[Budget]int
+	perIP   map[Budget]int
+}
+
+func New(cfg config.RateLimit, store shared.RateLimitStore) *Limiter {
+	return &Limiter{
+		enabled: cfg.Enabled,
+		store:   store,
+		local:   shared.NewMemoryRateLimitStore(),
+		perUser: map[Budget]int{
+			Messages:    cfg.MessagesPerUser,
+			Attachments: cfg.AttachmentsPerUser,
+			Auth:        cfg.AuthPerUser,
+		},
+		perIP: map[Budget]int{
+			Messages:    cfg.MessagesPerIP,
+			Attachments: cfg.AttachmentsPerIP,
+			Auth:        cfg.AuthPerIP,
+		},
+	}
+}
+
+// Allow takes one request of budget from userID, if not empty, and from ip.
+// It returns zero when the request may proceed, or how long to wait.
+func (l *Limiter) Allow(ctx context.Context, budget Budget, userID, ip string) time.Duration {
+	if !l.enabled {
+		return 0
+	}
+	// The user is checked first, so a single user over their limit does
+	// not also use up the budget of everyone behind the same address.
+	if n := l.perUser[budget]; n > 0 && userID != "" {
+		if wait := l.take(ctx, "ratelimit:"+string(budget)+":user:"+userID, n); wait > 0 {
+			metrics.RateLimited.WithLabelValues(string(budget)).Inc()
+			return wait
+		}
+	}
+	if n := l.perIP[budget]; n > 0 && ip != "" {
+		if wait := l.take(ctx, "ratelimit:"+string(budget)+":ip:"+ip, n); wait > 0 {
+			metrics.RateLimited.WithLabelValues(string(budget)).Inc()
+			return wait
+		}
+	}
+	return 0
+}
+
+func (l *Limiter) take(ctx context.Context, key string, perPeriod int) time.Duration {
+	rate := shared.Rate{Burst: perPeriod, Per: period}
+	wait, err := l.store.Take(ctx, key, rate)
+	if err != nil {
+		slog.WarnContext(ctx, "Rate limit store failed, limiting locally", "error", err)
+		wait, _ = l.local.Take(ctx, key, rate)
+	}
+	return wait
+}
+
+// Limit rejects requests over budget with 429 Too Many Requests. The user is
+// taken from the JWT claims, so it must run after shared.JWTMiddleware on
+// authenticated routes.
+func (l *Limiter) Limit(budget Budget, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var userID string
+		if claims, ok := r.Context().Value("userClaims").(jwt.MapClaims); ok {
+			userID, _ = claims["user_id"].(string)
+		}
+		if wait := l.Allow(r.Context(), budget, userID, shared.ClientIP(r)); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(RetryAfterSeconds(wait)))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RetryAfterSeconds rounds wait up to whole seconds, as used by Retry-After.
+func RetryAfterSeconds(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
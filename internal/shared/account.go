@@ -0,0 +1,74 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrAccountDeleted is returned for tokens of users whose account was deleted.
+var ErrAccountDeleted = errors.New("account deleted")
+
+// AccountDeletedChecker reports whether the account of userID was deleted.
+type AccountDeletedChecker func(ctx context.Context, userID string) (bool, error)
+
+// accountCacheTTL is how long a live account is trusted without asking the
+// database again. Deletions also revoke the tokens of the user, which covers
+// this window unless the state backend lost the marker.
+const accountCacheTTL = time.Minute
+
+// accountCacheSize bounds the live entries kept; the cache starts over when
+// it is full.
+const accountCacheSize = 10000
+
+var accounts = struct {
+	sync.Mutex
+	check   AccountDeletedChecker
+	live    map[string]time.Time
+	deleted map[string]bool
+}{live: make(map[string]time.Time), deleted: make(map[string]bool)}
+
+// SetAccountDeletedChecker makes ParseAccessToken and RedeemWSTicket reject
+// session tokens of deleted accounts.
+func SetAccountDeletedChecker(check AccountDeletedChecker) {
+	accounts.Lock()
+	defer accounts.Unlock()
+	accounts.check = check
+	accounts.live = make(map[string]time.Time)
+	accounts.deleted = make(map[string]bool)
+}
+
+// accountDeleted asks the checker whether userID was deleted. Deletion is
+// final, so deleted accounts are remembered for good. Unlike tokensRevoked it
+// fails closed: the database is the record of deletion.
+func accountDeleted(ctx context.Context, userID string) (bool, error) {
+	accounts.Lock()
+	check := accounts.check
+	if check == nil || accounts.deleted[userID] {
+		accounts.Unlock()
+		return check != nil, nil
+	}
+	if until, ok := accounts.live[userID]; ok && time.Now().Before(until) {
+		accounts.Unlock()
+		return false, nil
+	}
+	accounts.Unlock()
+
+	deleted, err := check(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	accounts.Lock()
+	defer accounts.Unlock()
+	if deleted {
+		accounts.deleted[userID] = true
+		delete(accounts.live, userID)
+	} else {
+		if len(accounts.live) >= accountCacheSize {
+			accounts.live = make(map[string]time.Time)
+		}
+		accounts.live[userID] = time.Now().Add(accountCacheTTL)
+	}
+	return deleted, nil
+}
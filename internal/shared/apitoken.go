@@ -0,0 +1,116 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// APITokenPrefix starts every personal API token so that leaked tokens are
+// easy to find with secret scanners.
+const APITokenPrefix = "rtc_"
+
+// Scopes that can be granted to API tokens. Session JWTs carry no scope claim
+// and are allowed everything.
+const (
+	ScopeMessagesRead  = "messages:read"
+	ScopeMessagesWrite = "messages:write"
+)
+
+var Scopes = []string{ScopeMessagesRead, ScopeMessagesWrite}
+
+// APITokenVerifier resolves a raw API token to its id, its owner and the
+// granted scopes.
+type APITokenVerifier func(ctx context.Context, token string) (tokenID, userID string, scopes []string, err error)
+
+var apiTokenVerifier APITokenVerifier
+
+// SetAPITokenVerifier enables API token authentication in JWTMiddleware.
+func SetAPITokenVerifier(v APITokenVerifier) {
+	apiTokenVerifier = v
+}
+
+func apiTokenClaims(ctx context.Context, token string) (jwt.MapClaims, error) {
+	if apiTokenVerifier == nil {
+		return nil, errors.New("API tokens are not enabled")
+	}
+	tokenID, userID, scopes, err := apiTokenVerifier(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	return jwt.MapClaims{
+		"user_id":  userID,
+		"scope":    scopes,
+		"auth":     "api_token",
+		"token_id": tokenID,
+	}, nil
+}
+
+func apiTokenRevokedKey(tokenID string) string {
+	return "api_token:" + tokenID + ":revoked"
+}
+
+// AnnounceAPITokenRevoked closes the WebSocket connections authenticated
+// with the API token tokenID of userID and stops tickets issued for it from
+// being redeemed. The token itself must already be revoked in the database.
+func AnnounceAPITokenRevoked(ctx context.Context, userID, tokenID string) error {
+	// Tickets outlive the revocation by WSTicketTTL at most.
+	if err := backend.KV.Set(ctx, apiTokenRevokedKey(tokenID), "1", WSTicketTTL); err != nil {
+		return err
+	}
+	return backend.PubSub.Publish(ctx, RevocationChannel, userID+" "+tokenID)
+}
+
+// apiTokenRevoked reports whether AnnounceAPITokenRevoked was called for
+// tokenID within the last WSTicketTTL. Store errors fail open like
+// tokensRevoked.
+func apiTokenRevoked(ctx context.Context, tokenID string) bool {
+	_, err := backend.KV.Get(ctx, apiTokenRevokedKey(tokenID))
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		slog.ErrorContext(ctx, "Failed to check API token revocation", "error", err)
+	}
+	return err == nil
+}
+
+// HasScope reports whether the authenticated request may use scope.
+func HasScope(claims jwt.MapClaims, scope string) bool {
+	switch scopes := claims["scope"].(type) {
+	case nil:
+		return true
+	case []string:
+		for _, s := range scopes {
+			if s == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RequireScope rejects API tokens that were not granted scope.
+func RequireScope(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value("userClaims").(jwt.MapClaims)
+		if !ok || !HasScope(claims, scope) {
+			http.Error(w, "Insufficient scope: "+scope+" required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireSession rejects API tokens altogether, for endpoints that manage the
+// account itself.
+func RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value("userClaims").(jwt.MapClaims)
+		if !ok || claims["auth"] == "api_token" {
+			http.Error(w, "This endpoint requires a user session", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
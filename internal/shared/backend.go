@@ -0,0 +1,92 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"RealtimeChat/internal/config"
+	"RealtimeChat/internal/metrics"
+	"RealtimeChat/internal/tracing"
+	"github.com/redis/go-redis/v9"
+)
+
+// Backend bundles the state that has to be shared between instances. The
+// Redis backend supports any number of instances; the memory backend keeps
+// everything in process, so a single instance can run with PostgreSQL only.
+type Backend struct {
+	KV       KeyValue
+	Presence PresenceStore
+	PubSub   PubSub
+	// RateLimit keeps the token buckets of the rate limits.
+	RateLimit RateLimitStore
+	// Ping checks that the backend is reachable.
+	Ping func(ctx context.Context) error
+	// Close releases the connections of the backend.
+	Close func() error
+}
+
+var backend *Backend
+
+// UseBackend makes b the backend of the package-level helpers such as
+// SetUserOnline and RevokeUserTokens.
+func UseBackend(b *Backend) {
+	backend = b
+}
+
+// NewBackend creates the backend selected by state.backend.
+func NewBackend(cfg *config.Config) (*Backend, error) {
+	switch cfg.State.Backend {
+	case "memory":
+		return NewMemoryBackend(), nil
+	case "redis":
+		rdb, err := NewRedisClient(cfg.Redis)
+		if err != nil {
+			return nil, err
+		}
+		return NewRedisBackend(rdb), nil
+	default:
+		return nil, fmt.Errorf("unknown state backend %q", cfg.State.Backend)
+	}
+}
+
+// NewRedisClient connects to Redis and checks that it is reachable.
+func NewRedisClient(cfg config.Redis) (*redis.Client, error) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     fmt.Sprintf("%s:%s", cfg.Host, cfg.Port),
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	})
+	rdb.AddHook(metrics.RedisHook{})
+	rdb.AddHook(tracing.RedisHook{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		rdb.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %v", err)
+	}
+	return rdb, nil
+}
+
+func NewRedisBackend(rdb *redis.Client) *Backend {
+	return &Backend{
+		KV:        NewRedisKeyValue(rdb),
+		Presence:  NewRedisPresenceStore(rdb),
+		PubSub:    NewRedisPubSub(rdb),
+		RateLimit: NewRedisRateLimitStore(rdb),
+		Ping:      func(ctx context.Context) error { return rdb.Ping(ctx).Err() },
+		Close:     rdb.Close,
+	}
+}
+
+func NewMemoryBackend() *Backend {
+	return &Backend{
+		KV:        NewMemoryKeyValue(),
+		Presence:  NewMemoryPresenceStore(),
+		PubSub:    NewMemoryPubSub(),
+		RateLimit: NewMemoryRateLimitStore(),
+		Ping:      func(ctx context.Context) error { return nil },
+		Close:     func() error { return nil },
+	}
+}
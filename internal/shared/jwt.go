@@ -2,40 +2,17 @@ package shared
 
 import (
 	"context"
-	"crypto/rsa"
+	"errors"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 	"fmt"
 	"github.com/golang-jwt/jwt/v5"
-	"log"
-	
-)
+	"log/slog"
 
-var (
-	PrivateKey *rsa.PrivateKey
-	PublicKey  *rsa.PublicKey
+	"RealtimeChat/internal/logging"
 )
 
-func LoadKeys(privateKeyPath, publicKeyPath string) error {
-	privateBytes, err := os.ReadFile(privateKeyPath)
-	if err != nil {
-		return err
-	}
-	PrivateKey, err = jwt.ParseRSAPrivateKeyFromPEM(privateBytes)
-	if err != nil {
-		return err
-	}
-
-	publicBytes, err := os.ReadFile(publicKeyPath)
-	if err != nil {
-		return err
-	}
-	PublicKey, err = jwt.ParseRSAPublicKeyFromPEM(publicBytes)
-	return err
-}
-
 func extractToken(r *http.Request) string {
     authHeader := r.Header.Get("Authorization")
     if authHeader == "" {
@@ -49,48 +26,151 @@ func extractToken(r *http.Request) string {
 }
 
 
+// ErrTokenRevoked is returned for session tokens issued before the last
+// RevokeUserTokens of their user.
+var ErrTokenRevoked = errors.New("token revoked")
+
+// errNotAccessToken is returned for tokens that are valid but grant no API
+// access, such as the challenge tokens issued mid-login.
+var errNotAccessToken = errors.New("not an access token")
+
 func JWTMiddleware(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        log.Println("Authorization header:", r.Header.Get("Authorization"))
-        
         tokenString := extractToken(r)
         if tokenString == "" {
             http.Error(w, "Authorization header missing", http.StatusUnauthorized)
             return
         }
 
-        log.Println("Token:", tokenString)
-        
-        token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-            if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-                return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-            }
-            return PublicKey, nil
-        })
-
+        claims, err := ParseAccessToken(r.Context(), tokenString)
         if err != nil {
-            log.Printf("Token validation error: %v", err)
-            http.Error(w, "Invalid token: "+err.Error(), http.StatusUnauthorized)
+            slog.InfoContext(r.Context(), "Token rejected", "error", err)
+            switch {
+            case errors.Is(err, ErrTokenRevoked), errors.Is(err, ErrAccountDeleted):
+                http.Error(w, "Token revoked", http.StatusUnauthorized)
+            case errors.Is(err, errNotAccessToken), strings.HasPrefix(tokenString, APITokenPrefix):
+                http.Error(w, "Invalid token", http.StatusUnauthorized)
+            default:
+                http.Error(w, "Invalid token: "+err.Error(), http.StatusUnauthorized)
+            }
             return
         }
+        next.ServeHTTP(w, r.WithContext(withClaims(r.Context(), claims)))
+    })
+}
 
-        if !token.Valid {
-            log.Println("Token is invalid")
-            http.Error(w, "Invalid token", http.StatusUnauthorized)
-            return
+// ParseAccessToken validates a session JWT or an API token and returns its
+// claims.
+func ParseAccessToken(ctx context.Context, tokenString string) (jwt.MapClaims, error) {
+    if strings.HasPrefix(tokenString, APITokenPrefix) {
+        return apiTokenClaims(ctx, tokenString)
+    }
+
+    token, err := jwt.Parse(tokenString, verificationKey)
+    if err != nil {
+        return nil, err
+    }
+    claims, ok := token.Claims.(jwt.MapClaims)
+    if !ok || !token.Valid {
+        return nil, errNotAccessToken
+    }
+    // Challenge tokens issued mid-login must not grant API access.
+    if claims["typ"] != nil {
+        return nil, errNotAccessToken
+    }
+
+    userID, _ := claims["user_id"].(string)
+    var issuedAt int64
+    if iat, err := claims.GetIssuedAt(); err == nil && iat != nil {
+        issuedAt = iat.Unix()
+    }
+    if tokensRevoked(ctx, userID, issuedAt) {
+        return nil, ErrTokenRevoked
+    }
+    // The revocation marker expires and may be lost with the state backend.
+    if deleted, err := accountDeleted(ctx, userID); err != nil {
+        return nil, err
+    } else if deleted {
+        return nil, ErrAccountDeleted
+    }
+    return claims, nil
+}
+
+// withClaims makes claims the authenticated user of the request context.
+func withClaims(ctx context.Context, claims jwt.MapClaims) context.Context {
+    logging.SetUserID(ctx, fmt.Sprintf("%v", claims["user_id"]))
+    return context.WithValue(ctx, "userClaims", claims)
+}
+
+// verificationKey picks the public key named by the token's kid. Tokens
+// issued before kids were introduced are checked against every known key.
+func verificationKey(token *jwt.Token) (interface{}, error) {
+    if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+        return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+    }
+    set := Keys()
+    if set == nil {
+        return nil, fmt.Errorf("keys not loaded")
+    }
+    kid, _ := token.Header["kid"].(string)
+    if kid == "" {
+        keys := make([]jwt.VerificationKey, 0, len(set.PublicKeys))
+        for _, key := range set.PublicKeys {
+            keys = append(keys, key)
         }
+        return jwt.VerificationKeySet{Keys: keys}, nil
+    }
+    key, ok := set.PublicKeys[kid]
+    if !ok {
+        return nil, fmt.Errorf("unknown kid %q", kid)
+    }
+    return key, nil
+}
 
-        log.Printf("Valid token with claims: %+v", token.Claims)
-        
-        ctx := context.WithValue(r.Context(), "userClaims", token.Claims)
-        next.ServeHTTP(w, r.WithContext(ctx))
-    })
+func signToken(claims jwt.MapClaims) (string, error) {
+	set := Keys()
+	if set == nil {
+		return "", fmt.Errorf("keys not loaded")
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = set.SigningKeyID
+	return token.SignedString(set.SigningKey)
+}
+
+const mfaTokenType = "mfa"
+
+// GenerateMFAToken issues a short-lived token proving that the password step
+// of a two-factor login succeeded. It is rejected by JWTMiddleware.
+func GenerateMFAToken(userID string, ttl time.Duration) (string, error) {
+	return signToken(jwt.MapClaims{
+		"user_id": userID,
+		"typ":     mfaTokenType,
+		"exp":     jwt.NewNumericDate(time.Now().Add(ttl)),
+	})
+}
+
+// ParseMFAToken validates a token from GenerateMFAToken and returns its user ID.
+func ParseMFAToken(tokenString string) (string, error) {
+	token, err := jwt.Parse(tokenString, verificationKey)
+	if err != nil {
+		return "", err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["typ"] != mfaTokenType {
+		return "", fmt.Errorf("not an MFA token")
+	}
+	userID, ok := claims["user_id"].(string)
+	if !ok || userID == "" {
+		return "", fmt.Errorf("MFA token has no user_id")
+	}
+	return userID, nil
 }
 
 func GenerateToken(userID string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+	now := time.Now()
+	return signToken(jwt.MapClaims{
 		"user_id": userID,
-		"exp":     jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+		"iat":     jwt.NewNumericDate(now),
+		"exp":     jwt.NewNumericDate(now.Add(tokenLifetime)),
 	})
-	return token.SignedString(PrivateKey)
 }
\ No newline at end of file
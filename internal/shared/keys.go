@@ -0,0 +1,214 @@
+package shared
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// KeySet holds every key accepted for verification, identified by kid, and
+// the one key currently used for signing.
+type KeySet struct {
+	SigningKeyID string
+	SigningKey   *rsa.PrivateKey
+	PublicKeys   map[string]*rsa.PublicKey
+}
+
+var currentKeys atomic.Pointer[KeySet]
+
+// Keys returns the active key set.
+func Keys() *KeySet {
+	return currentKeys.Load()
+}
+
+// LoadKeys loads a single RSA key pair. Its kid is the RFC 7638 thumbprint of
+// the public key.
+func LoadKeys(privateKeyPath, publicKeyPath string) error {
+	privateBytes, err := os.ReadFile(privateKeyPath)
+	if err != nil {
+		return err
+	}
+	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(privateBytes)
+	if err != nil {
+		return err
+	}
+
+	publicBytes, err := os.ReadFile(publicKeyPath)
+	if err != nil {
+		return err
+	}
+	publicKey, err := jwt.ParseRSAPublicKeyFromPEM(publicBytes)
+	if err != nil {
+		return err
+	}
+
+	kid := keyThumbprint(publicKey)
+	currentKeys.Store(&KeySet{
+		SigningKeyID: kid,
+		SigningKey:   privateKey,
+		PublicKeys:   map[string]*rsa.PublicKey{kid: publicKey},
+	})
+	return nil
+}
+
+// LoadKeyDir loads every <kid>.pem file in dir. Private keys can sign and
+// verify; public-only files keep retired keys valid until their tokens
+// expire. The signing key is signingKeyID, or the private key with the
+// greatest kid when it is empty (so date-named keys rotate in order).
+func LoadKeyDir(dir, signingKeyID string) error {
+	set, err := readKeyDir(dir, signingKeyID)
+	if err != nil {
+		return err
+	}
+	currentKeys.Store(set)
+	return nil
+}
+
+func readKeyDir(dir, signingKeyID string) (*KeySet, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	set := &KeySet{PublicKeys: make(map[string]*rsa.PublicKey)}
+	privateKeys := make(map[string]*rsa.PrivateKey)
+	for _, file := range files {
+		kid := strings.TrimSuffix(filepath.Base(file), ".pem")
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+			privateKeys[kid] = privateKey
+			set.PublicKeys[kid] = &privateKey.PublicKey
+			continue
+		}
+		publicKey, err := jwt.ParseRSAPublicKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", file, err)
+		}
+		set.PublicKeys[kid] = publicKey
+	}
+
+	if signingKeyID == "" {
+		kids := make([]string, 0, len(privateKeys))
+		for kid := range privateKeys {
+			kids = append(kids, kid)
+		}
+		sort.Strings(kids)
+		if len(kids) > 0 {
+			signingKeyID = kids[len(kids)-1]
+		}
+	}
+	privateKey, ok := privateKeys[signingKeyID]
+	if !ok {
+		return nil, fmt.Errorf("no private key for signing kid %q in %s", signingKeyID, dir)
+	}
+	set.SigningKeyID = signingKeyID
+	set.SigningKey = privateKey
+	return set, nil
+}
+
+// WatchKeyDir reloads the key directory on SIGHUP and, if interval is
+// positive, periodically. A failed reload keeps the previous key set.
+func WatchKeyDir(ctx context.Context, dir, signingKeyID string, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-tick:
+		}
+		set, err := readKeyDir(dir, signingKeyID)
+		if err != nil {
+			slog.Error("Failed to reload JWT keys", "error", err)
+			continue
+		}
+		if old := Keys(); old == nil || old.SigningKeyID != set.SigningKeyID || len(old.PublicKeys) != len(set.PublicKeys) {
+			slog.Info("JWT keys reloaded", "signing_kid", set.SigningKeyID, "verification_keys", len(set.PublicKeys))
+		}
+		currentKeys.Store(set)
+	}
+}
+
+func keyThumbprint(key *rsa.PublicKey) string {
+	// Members in lexicographic order, no whitespace, as RFC 7638 requires.
+	canonical := fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`,
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+	)
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKSHandler publishes the verification keys as a JSON Web Key Set so other
+// services can validate our tokens.
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	set := Keys()
+	if set == nil {
+		http.Error(w, "Keys not loaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	kids := make([]string, 0, len(set.PublicKeys))
+	for kid := range set.PublicKeys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	keys := make([]jwk, 0, len(kids))
+	for _, kid := range kids {
+		key := set.PublicKeys[kid]
+		keys = append(keys, jwk{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: jwt.SigningMethodRS256.Alg(),
+			Kid: kid,
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
@@ -0,0 +1,198 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrKeyNotFound = errors.New("key not found")
+
+// KeyValue is the key-value store with expiry used for login throttling,
+// OIDC login state and token revocation.
+type KeyValue interface {
+	// Get returns ErrKeyNotFound for a missing or expired key.
+	Get(ctx context.Context, key string) (string, error)
+	// Set stores value under key; a zero ttl keeps it forever.
+	Set(ctx context.Context, key, value string, ttl time.Duration) error
+	// GetDel returns the value of key and removes it atomically.
+	GetDel(ctx context.Context, key string) (string, error)
+	Del(ctx context.Context, keys ...string) error
+	// Incr increments the counter at key, (re)sets its expiry to ttl and
+	// returns the new value.
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+	// TTL returns the remaining lifetime of key, or zero when it does not
+	// exist or never expires.
+	TTL(ctx context.Context, key string) (time.Duration, error)
+}
+
+// RedisKeyValue stores keys in Redis, so they are shared by all instances.
+type RedisKeyValue struct {
+	rdb *redis.Client
+}
+
+func NewRedisKeyValue(rdb *redis.Client) *RedisKeyValue {
+	return &RedisKeyValue{rdb: rdb}
+}
+
+func (s *RedisKeyValue) Get(ctx context.Context, key string) (string, error) {
+	val, err := s.rdb.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", ErrKeyNotFound
+	}
+	return val, err
+}
+
+func (s *RedisKeyValue) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return s.rdb.Set(ctx, key, value, ttl).Err()
+}
+
+func (s *RedisKeyValue) GetDel(ctx context.Context, key string) (string, error) {
+	val, err := s.rdb.GetDel(ctx, key).Result()
+	if err == redis.Nil {
+		return "", ErrKeyNotFound
+	}
+	return val, err
+}
+
+func (s *RedisKeyValue) Del(ctx context.Context, keys ...string) error {
+	return s.rdb.Del(ctx, keys...).Err()
+}
+
+func (s *RedisKeyValue) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	pipe := s.rdb.TxPipeline()
+	incr := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+func (s *RedisKeyValue) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ttl, err := s.rdb.PTTL(ctx, key).Result()
+	if err != nil || ttl < 0 {
+		return 0, err
+	}
+	return ttl, nil
+}
+
+type memoryEntry struct {
+	value     string
+	expiresAt time.Time
+}
+
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+// MemoryKeyValue keeps keys in process memory for single-instance setups.
+type MemoryKeyValue struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	writes  int
+	now     func() time.Time
+}
+
+func NewMemoryKeyValue() *MemoryKeyValue {
+	return &MemoryKeyValue{entries: make(map[string]memoryEntry), now: time.Now}
+}
+
+func (s *MemoryKeyValue) get(key string, now time.Time) (memoryEntry, bool) {
+	e, ok := s.entries[key]
+	if ok && e.expired(now) {
+		delete(s.entries, key)
+		return memoryEntry{}, false
+	}
+	return e, ok
+}
+
+// put stores e and, every 1024 writes, drops expired entries so that keys
+// which are never read again do not pile up.
+func (s *MemoryKeyValue) put(key string, e memoryEntry, now time.Time) {
+	s.entries[key] = e
+	s.writes++
+	if s.writes%1024 == 0 {
+		for k, e := range s.entries {
+			if e.expired(now) {
+				delete(s.entries, k)
+			}
+		}
+	}
+}
+
+func expiry(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+func (s *MemoryKeyValue) Get(ctx context.Context, key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.get(key, s.now())
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	return e.value, nil
+}
+
+func (s *MemoryKeyValue) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.put(key, memoryEntry{value: value, expiresAt: expiry(now, ttl)}, now)
+	return nil
+}
+
+func (s *MemoryKeyValue) GetDel(ctx context.Context, key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.get(key, s.now())
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	delete(s.entries, key)
+	return e.value, nil
+}
+
+func (s *MemoryKeyValue) Del(ctx context.Context, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		delete(s.entries, key)
+	}
+	return nil
+}
+
+func (s *MemoryKeyValue) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	var n int64
+	if e, ok := s.get(key, now); ok {
+		var err error
+		if n, err = strconv.ParseInt(e.value, 10, 64); err != nil {
+			return 0, err
+		}
+	}
+	n++
+	s.put(key, memoryEntry{value: strconv.FormatInt(n, 10), expiresAt: expiry(now, ttl)}, now)
+	return n, nil
+}
+
+func (s *MemoryKeyValue) TTL(ctx context.Context, key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	e, ok := s.get(key, now)
+	if !ok || e.expiresAt.IsZero() {
+		return 0, nil
+	}
+	return e.expiresAt.Sub(now), nil
+}
@@ -0,0 +1,60 @@
+package shared
+
+import (
+	"fmt"
+	"log/slog"
+	"net/smtp"
+	"strings"
+
+	"RealtimeChat/internal/config"
+)
+
+// Mailer delivers plain-text emails to users.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// NewMailer returns an SMTP mailer, or a LogMailer when no SMTP host is configured.
+func NewMailer(cfg config.Mail) Mailer {
+	if cfg.Host == "" {
+		return LogMailer{}
+	}
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+	return &SMTPMailer{
+		addr: fmt.Sprintf("%s:%s", cfg.Host, cfg.Port),
+		from: cfg.From,
+		auth: auth,
+	}
+}
+
+// LogMailer logs that an email would have been sent instead of sending it.
+// The body is redacted, as it carries one-time tokens; point mail.host at a
+// local SMTP catcher to read emails during development.
+type LogMailer struct{}
+
+func (LogMailer) Send(to, subject, body string) error {
+	slog.Info("Mail not sent, no SMTP host configured", "to", to, "subject", subject, "body", body)
+	return nil
+}
+
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return fmt.Errorf("invalid mail header")
+	}
+	msg := "From: " + m.from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=\"utf-8\"\r\n" +
+		"\r\n" + body
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg))
+}
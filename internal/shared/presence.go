@@ -0,0 +1,340 @@
+package shared
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"RealtimeChat/internal/tracing"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// onlineTTL is how long a heartbeat keeps a user online.
+const onlineTTL = 60 * time.Second
+
+// PresenceStore keeps the online heartbeats and last seen times of users.
+type PresenceStore interface {
+	// SetOnline refreshes the heartbeat of userID, records the time as their
+	// last seen and reports whether they were offline before.
+	SetOnline(ctx context.Context, userID string) (bool, error)
+	// SetOffline ends the presence of userID and reports whether they were
+	// online.
+	SetOffline(ctx context.Context, userID string) (bool, error)
+	// AreUsersOnline reports which of userIDs are online in one round trip.
+	AreUsersOnline(ctx context.Context, userIDs []string) (map[string]bool, error)
+	// LastSeen returns the last recorded heartbeat of each of userIDs that
+	// has one.
+	LastSeen(ctx context.Context, userIDs []string) (map[string]time.Time, error)
+	// PopLastSeen returns up to limit users whose last seen time changed
+	// since they were last popped.
+	PopLastSeen(ctx context.Context, limit int) (map[string]time.Time, error)
+	// WatchExpired calls fn with every user whose heartbeat expired until
+	// ctx is cancelled.
+	WatchExpired(ctx context.Context, fn func(ctx context.Context, userID string))
+}
+
+// PresenceChannel carries the ids of users whose presence changed, so that
+// every instance can notify its own WebSocket clients. Expiring online keys
+// are reported by Redis keyspace notifications instead.
+const PresenceChannel = "presence:changed"
+
+func PublishPresenceChanged(ctx context.Context, userID string) error {
+	return backend.PubSub.Publish(ctx, PresenceChannel, userID)
+}
+
+// SetUserOnline is the presence heartbeat. A user coming online is
+// announced on PresenceChannel.
+func SetUserOnline(ctx context.Context, userID string) (err error) {
+	ctx, span := tracing.Start(ctx, "presence.SetUserOnline")
+	defer tracing.End(span, &err)
+	cameOnline, err := backend.Presence.SetOnline(ctx, userID)
+	if err != nil || !cameOnline {
+		return err
+	}
+	return PublishPresenceChanged(ctx, userID)
+}
+
+// SetUserOffline ends the presence of a user who disconnected instead of
+// waiting for the heartbeat to expire.
+func SetUserOffline(ctx context.Context, userID string) (err error) {
+	ctx, span := tracing.Start(ctx, "presence.SetUserOffline")
+	defer tracing.End(span, &err)
+	wasOnline, err := backend.Presence.SetOffline(ctx, userID)
+	if err != nil || !wasOnline {
+		return err
+	}
+	return PublishPresenceChanged(ctx, userID)
+}
+
+func IsUserOnline(ctx context.Context, userID string) (bool, error) {
+	online, err := backend.Presence.AreUsersOnline(ctx, []string{userID})
+	return online[userID], err
+}
+
+func AreUsersOnline(ctx context.Context, userIDs []string) (_ map[string]bool, err error) {
+	ctx, span := tracing.Start(ctx, "presence.AreUsersOnline", attribute.Int("presence.users", len(userIDs)))
+	defer tracing.End(span, &err)
+	return backend.Presence.AreUsersOnline(ctx, userIDs)
+}
+
+// LastSeenDirtyKey is the set of users whose last seen time changed since it
+// was last popped.
+const LastSeenDirtyKey = "presence:last_seen:dirty"
+
+// lastSeenTTL only bounds the memory used by idle users; the database keeps
+// the last seen time for good.
+const lastSeenTTL = 30 * 24 * time.Hour
+
+func OnlineKey(userID string) string {
+	return "user:" + userID + ":online"
+}
+
+func LastSeenKey(userID string) string {
+	return "user:" + userID + ":last_seen"
+}
+
+// RedisPresenceStore keeps presence in Redis keys with a TTL, so it is shared
+// by all instances.
+type RedisPresenceStore struct {
+	rdb *redis.Client
+}
+
+func NewRedisPresenceStore(rdb *redis.Client) *RedisPresenceStore {
+	return &RedisPresenceStore{rdb: rdb}
+}
+
+func (s *RedisPresenceStore) SetOnline(ctx context.Context, userID string) (bool, error) {
+	pipe := s.rdb.Pipeline()
+	online := pipe.SetArgs(ctx, OnlineKey(userID), "true", redis.SetArgs{TTL: onlineTTL, Get: true})
+	pipe.Set(ctx, LastSeenKey(userID), time.Now().Unix(), lastSeenTTL)
+	pipe.SAdd(ctx, LastSeenDirtyKey, userID)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return false, err
+	}
+	return online.Err() == redis.Nil, nil
+}
+
+func (s *RedisPresenceStore) SetOffline(ctx context.Context, userID string) (bool, error) {
+	n, err := s.rdb.Del(ctx, OnlineKey(userID)).Result()
+	return n > 0, err
+}
+
+func (s *RedisPresenceStore) AreUsersOnline(ctx context.Context, userIDs []string) (map[string]bool, error) {
+	online := make(map[string]bool, len(userIDs))
+	if len(userIDs) == 0 {
+		return online, nil
+	}
+	keys := make([]string, len(userIDs))
+	for i, id := range userIDs {
+		keys[i] = OnlineKey(id)
+	}
+	values, err := s.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return online, err
+	}
+	for i, v := range values {
+		online[userIDs[i]] = v == "true"
+	}
+	return online, nil
+}
+
+func (s *RedisPresenceStore) LastSeen(ctx context.Context, userIDs []string) (map[string]time.Time, error) {
+	if len(userIDs) == 0 {
+		return map[string]time.Time{}, nil
+	}
+	keys := make([]string, len(userIDs))
+	for i, id := range userIDs {
+		keys[i] = LastSeenKey(id)
+	}
+	values, err := s.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return map[string]time.Time{}, err
+	}
+	return parseLastSeen(userIDs, values), nil
+}
+
+func (s *RedisPresenceStore) PopLastSeen(ctx context.Context, limit int) (map[string]time.Time, error) {
+	userIDs, err := s.rdb.SPopN(ctx, LastSeenDirtyKey, int64(limit)).Result()
+	if err != nil || len(userIDs) == 0 {
+		return map[string]time.Time{}, err
+	}
+	return s.LastSeen(ctx, userIDs)
+}
+
+const expiredEvents = "__keyevent@*__:expired"
+
+// enableExpiryNotifications turns on the keyspace notifications for expired
+// keys, keeping whatever other classes are already enabled. Managed Redis
+// services often forbid CONFIG; they must then be configured with
+// notify-keyspace-events "Ex" by hand.
+func (s *RedisPresenceStore) enableExpiryNotifications(ctx context.Context) {
+	current, err := s.rdb.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		slog.Warn("Failed to read notify-keyspace-events, presence expiry events may be missing", "error", err)
+		return
+	}
+	flags := current["notify-keyspace-events"]
+	want := flags
+	if !strings.Contains(want, "E") {
+		want += "E"
+	}
+	// "A" is an alias that includes "x".
+	if !strings.ContainsAny(want, "xA") {
+		want += "x"
+	}
+	if want == flags {
+		return
+	}
+	if err := s.rdb.ConfigSet(ctx, "notify-keyspace-events", want).Err(); err != nil {
+		slog.Warn("Failed to enable keyspace notifications, presence expiry events may be missing", "error", err)
+	}
+}
+
+// WatchExpired listens to Redis keyspace notifications for expired online
+// keys, so every instance learns about expiries no matter where the
+// heartbeat was set.
+func (s *RedisPresenceStore) WatchExpired(ctx context.Context, fn func(ctx context.Context, userID string)) {
+	s.enableExpiryNotifications(ctx)
+
+	sub := s.rdb.PSubscribe(ctx, expiredEvents)
+	defer sub.Close()
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			// Expired key events carry the key name.
+			if id, ok := strings.CutPrefix(msg.Payload, "user:"); ok {
+				if id, ok := strings.CutSuffix(id, ":online"); ok {
+					fn(ctx, id)
+				}
+			}
+		}
+	}
+}
+
+func parseLastSeen(userIDs []string, values []interface{}) map[string]time.Time {
+	seen := make(map[string]time.Time, len(userIDs))
+	for i, v := range values {
+		str, ok := v.(string)
+		if !ok {
+			continue
+		}
+		ts, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			continue
+		}
+		seen[userIDs[i]] = time.Unix(ts, 0)
+	}
+	return seen
+}
+
+// MemoryPresenceStore keeps presence in process memory. It is meant for
+// tests and single-instance setups.
+type MemoryPresenceStore struct {
+	mu          sync.Mutex
+	onlineUntil map[string]time.Time
+	lastSeen    map[string]time.Time
+	dirty       map[string]bool
+	// now is the clock, replaceable in tests.
+	now func() time.Time
+}
+
+func NewMemoryPresenceStore() *MemoryPresenceStore {
+	return &MemoryPresenceStore{
+		onlineUntil: make(map[string]time.Time),
+		lastSeen:    make(map[string]time.Time),
+		dirty:       make(map[string]bool),
+		now:         time.Now,
+	}
+}
+
+func (s *MemoryPresenceStore) SetOnline(ctx context.Context, userID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	wasOnline := s.onlineUntil[userID].After(now)
+	s.onlineUntil[userID] = now.Add(onlineTTL)
+	s.lastSeen[userID] = now.Truncate(time.Second)
+	s.dirty[userID] = true
+	return !wasOnline, nil
+}
+
+func (s *MemoryPresenceStore) SetOffline(ctx context.Context, userID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wasOnline := s.onlineUntil[userID].After(s.now())
+	delete(s.onlineUntil, userID)
+	return wasOnline, nil
+}
+
+func (s *MemoryPresenceStore) AreUsersOnline(ctx context.Context, userIDs []string) (map[string]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	online := make(map[string]bool, len(userIDs))
+	for _, id := range userIDs {
+		online[id] = s.onlineUntil[id].After(now)
+	}
+	return online, nil
+}
+
+func (s *MemoryPresenceStore) LastSeen(ctx context.Context, userIDs []string) (map[string]time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]time.Time, len(userIDs))
+	for _, id := range userIDs {
+		if t, ok := s.lastSeen[id]; ok {
+			seen[id] = t
+		}
+	}
+	return seen, nil
+}
+
+func (s *MemoryPresenceStore) PopLastSeen(ctx context.Context, limit int) (map[string]time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]time.Time)
+	for id := range s.dirty {
+		if len(seen) >= limit {
+			break
+		}
+		seen[id] = s.lastSeen[id]
+		delete(s.dirty, id)
+	}
+	return seen, nil
+}
+
+// WatchExpired sweeps the heartbeats once a second.
+func (s *MemoryPresenceStore) WatchExpired(ctx context.Context, fn func(ctx context.Context, userID string)) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		now := s.now()
+		var expired []string
+		for id, until := range s.onlineUntil {
+			if !until.After(now) {
+				expired = append(expired, id)
+				delete(s.onlineUntil, id)
+			}
+		}
+		s.mu.Unlock()
+		for _, id := range expired {
+			fn(ctx, id)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package shared
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a settable clock for MemoryPresenceStore.
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func newTestPresenceStore() (*MemoryPresenceStore, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	s := NewMemoryPresenceStore()
+	s.now = clock.now
+	return s, clock
+}
+
+func TestMemoryPresenceTransitions(t *testing.T) {
+	s, clock := newTestPresenceStore()
+	ctx := context.Background()
+
+	steps := []struct {
+		name    string
+		do      func() (bool, error)
+		changed bool
+		online  bool
+	}{
+		{"first heartbeat comes online", func() (bool, error) { return s.SetOnline(ctx, "u1") }, true, true},
+		{"heartbeat while online", func() (bool, error) { return s.SetOnline(ctx, "u1") }, false, true},
+		{"disconnect goes offline", func() (bool, error) { return s.SetOffline(ctx, "u1") }, true, false},
+		{"disconnect while offline", func() (bool, error) { return s.SetOffline(ctx, "u1") }, false, false},
+		{"heartbeat after disconnect", func() (bool, error) { return s.SetOnline(ctx, "u1") }, true, true},
+		{"heartbeat after expiry", func() (bool, error) {
+			clock.advance(onlineTTL)
+			return s.SetOnline(ctx, "u1")
+		}, true, true},
+	}
+	for _, step := range steps {
+		changed, err := step.do()
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if changed != step.changed {
+			t.Errorf("%s: changed = %v, want %v", step.name, changed, step.changed)
+		}
+		online, _ := s.AreUsersOnline(ctx, []string{"u1", "u2"})
+		if online["u1"] != step.online || online["u2"] {
+			t.Errorf("%s: online = %v, want u1 %v", step.name, online, step.online)
+		}
+	}
+
+	// Going offline keeps the last seen time of the last heartbeat.
+	clock.advance(1500 * time.Millisecond)
+	s.SetOffline(ctx, "u1")
+	seen, _ := s.LastSeen(ctx, []string{"u1", "u2"})
+	want := time.Unix(1700000000, 0).Add(onlineTTL)
+	if len(seen) != 1 || !seen["u1"].Equal(want) {
+		t.Errorf("last seen = %v, want u1 at %v", seen, want)
+	}
+}
+
+func TestMemoryPresenceWatchExpired(t *testing.T) {
+	s, clock := newTestPresenceStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s.SetOnline(ctx, "stale")
+	clock.advance(onlineTTL / 2)
+	s.SetOnline(ctx, "fresh")
+	s.SetOnline(ctx, "gone")
+	s.SetOffline(ctx, "gone")
+	clock.advance(onlineTTL / 2)
+
+	expired := make(chan string, 3)
+	go s.WatchExpired(ctx, func(ctx context.Context, userID string) { expired <- userID })
+
+	select {
+	case id := <-expired:
+		if id != "stale" {
+			t.Fatalf("expired %q, want stale", id)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("stale heartbeat was not reported")
+	}
+	online, _ := s.AreUsersOnline(ctx, []string{"stale", "fresh"})
+	if online["stale"] || !online["fresh"] {
+		t.Errorf("online = %v, want only fresh", online)
+	}
+
+	// Users who disconnected are not reported again, and an expired user
+	// only once.
+	select {
+	case id := <-expired:
+		t.Errorf("unexpected expiry of %q", id)
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
+
+func TestMemoryPresencePopLastSeen(t *testing.T) {
+	s, clock := newTestPresenceStore()
+	ctx := context.Background()
+
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		s.SetOnline(ctx, id)
+	}
+
+	popped := make(map[string]time.Time)
+	for _, limit := range []int{2, 2, 2} {
+		batch, err := s.PopLastSeen(ctx, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(batch) > limit {
+			t.Fatalf("batch of %d with limit %d", len(batch), limit)
+		}
+		for id, ts := range batch {
+			if _, dup := popped[id]; dup {
+				t.Errorf("%s popped twice", id)
+			}
+			popped[id] = ts
+		}
+	}
+	if len(popped) != 5 {
+		t.Fatalf("popped %v, want all 5 users", popped)
+	}
+	if batch, _ := s.PopLastSeen(ctx, 10); len(batch) != 0 {
+		t.Errorf("nothing changed, popped %v", batch)
+	}
+
+	// A new heartbeat makes the user pending again, with the new time
+	// truncated to the second.
+	clock.advance(90*time.Second + 500*time.Millisecond)
+	s.SetOnline(ctx, "c")
+	batch, _ := s.PopLastSeen(ctx, 10)
+	want := time.Unix(1700000000+90, 0)
+	if len(batch) != 1 || !batch["c"].Equal(want) {
+		t.Errorf("popped %v, want c at %v", batch, want)
+	}
+}
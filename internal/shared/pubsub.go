@@ -0,0 +1,101 @@
+package shared
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"RealtimeChat/internal/tracing"
+	"github.com/redis/go-redis/v9"
+)
+
+// PubSub broadcasts small messages to every instance. The trace context of
+// the publisher travels with the message.
+type PubSub interface {
+	Publish(ctx context.Context, channel, payload string) error
+	// Subscribe calls fn for every payload published on channel until ctx
+	// is cancelled. The context passed to fn carries the publisher's trace.
+	Subscribe(ctx context.Context, channel string, fn func(ctx context.Context, payload string))
+}
+
+type RedisPubSub struct {
+	rdb *redis.Client
+}
+
+func NewRedisPubSub(rdb *redis.Client) *RedisPubSub {
+	return &RedisPubSub{rdb: rdb}
+}
+
+func (p *RedisPubSub) Publish(ctx context.Context, channel, payload string) error {
+	return p.rdb.Publish(ctx, channel, tracing.Inject(ctx, payload)).Err()
+}
+
+func (p *RedisPubSub) Subscribe(ctx context.Context, channel string, fn func(ctx context.Context, payload string)) {
+	// The client reconnects and resubscribes by itself after errors.
+	sub := p.rdb.Subscribe(ctx, channel)
+	defer sub.Close()
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			fn(tracing.Extract(ctx, msg.Payload))
+		}
+	}
+}
+
+// memorySubscriberBuffer is how many messages a slow in-memory subscriber
+// may fall behind before messages are dropped.
+const memorySubscriberBuffer = 256
+
+// MemoryPubSub delivers messages within the process only.
+type MemoryPubSub struct {
+	mu          sync.RWMutex
+	subscribers map[string]map[chan string]bool
+}
+
+func NewMemoryPubSub() *MemoryPubSub {
+	return &MemoryPubSub{subscribers: make(map[string]map[chan string]bool)}
+}
+
+func (p *MemoryPubSub) Publish(ctx context.Context, channel, payload string) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for ch := range p.subscribers[channel] {
+		select {
+		case ch <- tracing.Inject(ctx, payload):
+		default:
+			slog.Warn("PubSub: subscriber is too slow, message dropped", "channel", channel)
+		}
+	}
+	return nil
+}
+
+func (p *MemoryPubSub) Subscribe(ctx context.Context, channel string, fn func(ctx context.Context, payload string)) {
+	ch := make(chan string, memorySubscriberBuffer)
+	p.mu.Lock()
+	if p.subscribers[channel] == nil {
+		p.subscribers[channel] = make(map[chan string]bool)
+	}
+	p.subscribers[channel][ch] = true
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.subscribers[channel], ch)
+		p.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-ch:
+			fn(tracing.Extract(ctx, msg))
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package shared
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Rate is a token bucket: it holds up to Burst tokens and regains Burst
+// tokens every Per.
+type Rate struct {
+	Burst int
+	Per   time.Duration
+}
+
+// interval is the time it takes to regain one token.
+func (r Rate) interval() time.Duration {
+	return r.Per / time.Duration(r.Burst)
+}
+
+// RateLimitStore keeps token buckets.
+type RateLimitStore interface {
+	// Take removes a token from the bucket at key, creating a full one if
+	// needed. When the bucket is empty nothing is taken and the time until
+	// the next token is returned instead.
+	Take(ctx context.Context, key string, rate Rate) (time.Duration, error)
+}
+
+// takeScript refills and takes from a bucket stored as a hash of the tokens
+// left and the time of the last update. The Redis clock is used, so that
+// instances with skewed clocks agree.
+var takeScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(b[1]) or burst
+local ts = tonumber(b[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) / interval)
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) * interval)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst * interval))
+return wait
+`)
+
+// RedisRateLimitStore keeps buckets in Redis, so a limit holds across all
+// instances.
+type RedisRateLimitStore struct {
+	rdb *redis.Client
+}
+
+func NewRedisRateLimitStore(rdb *redis.Client) *RedisRateLimitStore {
+	return &RedisRateLimitStore{rdb: rdb}
+}
+
+func (s *RedisRateLimitStore) Take(ctx context.Context, key string, rate Rate) (time.Duration, error) {
+	intervalMs := float64(rate.interval()) / float64(time.Millisecond)
+	wait, err := takeScript.Run(ctx, s.rdb, []string{key}, rate.Burst, intervalMs).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// MemoryRateLimitStore keeps buckets in process memory. It is the store of
+// the memory backend and the fallback while Redis is unreachable.
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	created int
+	now     func() time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: make(map[string]*bucket), now: time.Now}
+}
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, rate Rate) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	interval := rate.interval()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(rate.Burst), updated: now}
+		s.buckets[key] = b
+		s.sweep(now)
+	}
+	b.tokens = math.Min(float64(rate.Burst), b.tokens+float64(now.Sub(b.updated))/float64(interval))
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, nil
+	}
+	return time.Duration(math.Ceil((1 - b.tokens) * float64(interval))), nil
+}
+
+// sweep drops, every 1024 new buckets, those that have not been used for an
+// hour, so that one-off keys do not pile up. Buckets refill well before that.
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	s.created++
+	if s.created%1024 != 0 {
+		return
+	}
+	for key, b := range s.buckets {
+		if now.Sub(b.updated) > time.Hour {
+			delete(s.buckets, key)
+		}
+	}
+}
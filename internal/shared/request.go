@@ -0,0 +1,15 @@
+package shared
+
+import (
+	"net"
+	"net/http"
+)
+
+// ClientIP returns the address of the directly connected peer.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
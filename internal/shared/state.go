@@ -0,0 +1,65 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tokenLifetime bounds how long a revocation marker must be kept: older
+// tokens have expired anyway.
+const tokenLifetime = 24 * time.Hour
+
+func revokedBeforeKey(userID string) string {
+	return "user:" + userID + ":revoked_before"
+}
+
+// RevocationChannel carries the ids of users whose tokens were revoked, so
+// that every instance can close their WebSocket connections. A user id
+// followed by a space and an API token id only concerns that token.
+const RevocationChannel = "user:revoked"
+
+// RevokeUserTokens invalidates every session token issued to userID so far
+// and announces it on RevocationChannel. Tokens carry whole seconds, so one
+// issued later in the same second stays valid; callers can revoke and then
+// log the user in again.
+func RevokeUserTokens(ctx context.Context, userID string) error {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	if err := backend.KV.Set(ctx, revokedBeforeKey(userID), now, tokenLifetime+time.Hour); err != nil {
+		return err
+	}
+	return backend.PubSub.Publish(ctx, RevocationChannel, userID)
+}
+
+// WatchRevocations calls fn with every user whose tokens are revoked until
+// ctx is cancelled. tokenID is set when a single API token was revoked and
+// empty when all tokens of the user were.
+func WatchRevocations(ctx context.Context, fn func(ctx context.Context, userID, tokenID string)) {
+	backend.PubSub.Subscribe(ctx, RevocationChannel, func(ctx context.Context, payload string) {
+		userID, tokenID, _ := strings.Cut(payload, " ")
+		fn(ctx, userID, tokenID)
+	})
+}
+
+// tokensRevoked reports whether a token issued at issuedAt was revoked by
+// RevokeUserTokens. Store errors fail open so an outage does not log
+// everybody out.
+func tokensRevoked(ctx context.Context, userID string, issuedAt int64) bool {
+	val, err := backend.KV.Get(ctx, revokedBeforeKey(userID))
+	if errors.Is(err, ErrKeyNotFound) {
+		return false
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to check token revocation", "error", err)
+		return false
+	}
+	revokedBefore, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		slog.ErrorContext(ctx, "Invalid token revocation marker", "user_id", userID, "error", err)
+		return false
+	}
+	return issuedAt < revokedBefore
+}
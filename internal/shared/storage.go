@@ -0,0 +1,87 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage keeps uploaded files (attachments, avatars). Paths returned by
+// Save are what gets stored in the database.
+type Storage interface {
+	Save(name string, r io.Reader) (string, error)
+	Open(path string) (io.ReadCloser, error)
+	Delete(path string) error
+	// Check reports whether new files can be stored.
+	Check(ctx context.Context) error
+}
+
+// LocalStorage stores files in a directory on disk.
+type LocalStorage struct {
+	dir string
+}
+
+func NewLocalStorage(dir string) (*LocalStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create storage dir: %v", err)
+	}
+	return &LocalStorage{dir: dir}, nil
+}
+
+func (s *LocalStorage) Save(name string, r io.Reader) (string, error) {
+	path := filepath.Join(s.dir, fmt.Sprintf("%d_%s", time.Now().UnixNano(), filepath.Base(name)))
+	out, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		os.Remove(path)
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+func (s *LocalStorage) Open(path string) (io.ReadCloser, error) {
+	if err := s.checkPath(path); err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (s *LocalStorage) Delete(path string) error {
+	if err := s.checkPath(path); err != nil {
+		return err
+	}
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *LocalStorage) Check(ctx context.Context) error {
+	f, err := os.CreateTemp(s.dir, ".check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkPath refuses paths outside the storage directory.
+func (s *LocalStorage) checkPath(path string) error {
+	rel, err := filepath.Rel(s.dir, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("path %q is outside storage", path)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package shared
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// WSTicketTTL is how long a WebSocket ticket may be redeemed.
+const WSTicketTTL = 30 * time.Second
+
+var ErrInvalidWSTicket = errors.New("invalid or expired ticket")
+
+// wsTicket is what a ticket stands for: the claims of the token it was
+// issued for. A nil Scope means every scope, as for session tokens.
+type wsTicket struct {
+	UserID   string   `json:"user_id"`
+	Scope    []string `json:"scope"`
+	Auth     string   `json:"auth,omitempty"`
+	TokenID  string   `json:"token_id,omitempty"`
+	IssuedAt int64    `json:"iat,omitempty"`
+	Expires  int64    `json:"exp,omitempty"`
+}
+
+func wsTicketKey(ticket string) string { return "ws:ticket:" + ticket }
+
+// IssueWSTicket returns a single-use ticket that lets a browser, which
+// cannot set an Authorization header on the handshake, open /ws as the
+// owner of claims. The connection inherits the expiry of the token.
+func IssueWSTicket(ctx context.Context, claims jwt.MapClaims) (string, error) {
+	t := wsTicket{}
+	t.UserID, _ = claims["user_id"].(string)
+	t.Scope, _ = claims["scope"].([]string)
+	t.Auth, _ = claims["auth"].(string)
+	t.TokenID, _ = claims["token_id"].(string)
+	if iat, err := claims.GetIssuedAt(); err == nil && iat != nil {
+		t.IssuedAt = iat.Unix()
+	}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		t.Expires = exp.Unix()
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	ticket := base64.RawURLEncoding.EncodeToString(b)
+	if err := backend.KV.Set(ctx, wsTicketKey(ticket), string(data), WSTicketTTL); err != nil {
+		return "", err
+	}
+	return ticket, nil
+}
+
+// RedeemWSTicket consumes ticket and returns the claims it was issued for.
+func RedeemWSTicket(ctx context.Context, ticket string) (jwt.MapClaims, error) {
+	data, err := backend.KV.GetDel(ctx, wsTicketKey(ticket))
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, ErrInvalidWSTicket
+	}
+	if err != nil {
+		return nil, err
+	}
+	var t wsTicket
+	if err := json.Unmarshal([]byte(data), &t); err != nil {
+		return nil, err
+	}
+	// The token may have been revoked or expired since.
+	if t.Expires != 0 && time.Now().Unix() >= t.Expires {
+		return nil, ErrInvalidWSTicket
+	}
+	if t.Auth == "" && tokensRevoked(ctx, t.UserID, t.IssuedAt) {
+		return nil, ErrTokenRevoked
+	}
+	if t.TokenID != "" && apiTokenRevoked(ctx, t.TokenID) {
+		return nil, ErrTokenRevoked
+	}
+	if t.Auth == "" {
+		if deleted, err := accountDeleted(ctx, t.UserID); err != nil {
+			return nil, err
+		} else if deleted {
+			return nil, ErrAccountDeleted
+		}
+	}
+
+	claims := jwt.MapClaims{"user_id": t.UserID}
+	if t.Scope != nil {
+		claims["scope"] = t.Scope
+	}
+	if t.Auth != "" {
+		claims["auth"] = t.Auth
+	}
+	if t.TokenID != "" {
+		claims["token_id"] = t.TokenID
+	}
+	// Numbers as in parsed tokens, so GetExpirationTime and friends work.
+	if t.IssuedAt != 0 {
+		claims["iat"] = float64(t.IssuedAt)
+	}
+	if t.Expires != 0 {
+		claims["exp"] = float64(t.Expires)
+	}
+	return claims, nil
+}
+
+// WebSocketAuth authenticates WebSocket handshakes by the ticket query
+// parameter from IssueWSTicket, falling back to JWTMiddleware for clients
+// that can send an Authorization header.
+func WebSocketAuth(next http.Handler) http.Handler {
+	bearer := JWTMiddleware(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ticket := r.URL.Query().Get("ticket")
+		if ticket == "" {
+			bearer.ServeHTTP(w, r)
+			return
+		}
+		claims, err := RedeemWSTicket(r.Context(), ticket)
+		if err != nil {
+			slog.InfoContext(r.Context(), "WebSocket ticket rejected", "error", err)
+			http.Error(w, "Invalid or expired ticket", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withClaims(r.Context(), claims)))
+	})
+}
@@ -0,0 +1,103 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestRedeemWSTicketChecksRevocation(t *testing.T) {
+	UseBackend(NewMemoryBackend())
+	ctx := context.Background()
+
+	revoked := make(chan string, 2)
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go WatchRevocations(subCtx, func(ctx context.Context, userID, tokenID string) {
+		revoked <- userID + "/" + tokenID
+	})
+	// Let the subscription start before publishing.
+	time.Sleep(50 * time.Millisecond)
+
+	session := jwt.MapClaims{"user_id": "u1", "iat": float64(time.Now().Add(-time.Minute).Unix())}
+	api := jwt.MapClaims{"user_id": "u1", "auth": "api_token", "token_id": "t1", "scope": []string{ScopeMessagesRead}}
+	other := jwt.MapClaims{"user_id": "u1", "auth": "api_token", "token_id": "t2", "scope": []string{ScopeMessagesRead}}
+
+	var tickets []string
+	for _, claims := range []jwt.MapClaims{session, api, other} {
+		ticket, err := IssueWSTicket(ctx, claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tickets = append(tickets, ticket)
+	}
+
+	if err := RevokeUserTokens(ctx, "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := AnnounceAPITokenRevoked(ctx, "u1", "t1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RedeemWSTicket(ctx, tickets[0]); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("session ticket: err = %v, want ErrTokenRevoked", err)
+	}
+	if _, err := RedeemWSTicket(ctx, tickets[1]); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("revoked API token ticket: err = %v, want ErrTokenRevoked", err)
+	}
+	claims, err := RedeemWSTicket(ctx, tickets[2])
+	if err != nil {
+		t.Fatalf("other API token ticket: %v", err)
+	}
+	if claims["token_id"] != "t2" {
+		t.Errorf("claims = %v, want token_id t2", claims)
+	}
+
+	for _, want := range []string{"u1/", "u1/t1"} {
+		select {
+		case got := <-revoked:
+			if got != want {
+				t.Errorf("revocation event %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no revocation event %q", want)
+		}
+	}
+}
+
+func TestRedeemWSTicketRejectsDeletedAccount(t *testing.T) {
+	UseBackend(NewMemoryBackend())
+	ctx := context.Background()
+
+	// Deleted without a revocation marker, as after a state backend restart.
+	deleted := map[string]bool{"gone": true}
+	lookups := 0
+	SetAccountDeletedChecker(func(ctx context.Context, userID string) (bool, error) {
+		lookups++
+		return deleted[userID], nil
+	})
+	t.Cleanup(func() { SetAccountDeletedChecker(nil) })
+
+	redeem := func(userID string) error {
+		ticket, err := IssueWSTicket(ctx, jwt.MapClaims{"user_id": userID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = RedeemWSTicket(ctx, ticket)
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if err := redeem("gone"); !errors.Is(err, ErrAccountDeleted) {
+			t.Errorf("deleted account: err = %v, want ErrAccountDeleted", err)
+		}
+		if err := redeem("alive"); err != nil {
+			t.Errorf("live account: %v", err)
+		}
+	}
+	if lookups != 2 {
+		t.Errorf("%d lookups, want one per user", lookups)
+	}
+}
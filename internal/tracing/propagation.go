@@ -0,0 +1,45 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// envelope carries the trace context next to a pub/sub payload, so work
+// done by subscribers on other instances joins the publisher's trace.
+type envelope struct {
+	Trace   map[string]string `json:"otel"`
+	Payload string            `json:"payload"`
+}
+
+// Inject wraps payload with the trace context of ctx. Without a trace the
+// payload is returned unchanged.
+func Inject(ctx context.Context, payload string) string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return payload
+	}
+	data, err := json.Marshal(envelope{Trace: carrier, Payload: payload})
+	if err != nil {
+		return payload
+	}
+	return string(data)
+}
+
+// Extract undoes Inject, returning ctx with the remote trace context and
+// the original payload. Messages published without a trace pass through.
+func Extract(ctx context.Context, msg string) (context.Context, string) {
+	if !strings.HasPrefix(msg, `{"otel":`) {
+		return ctx, msg
+	}
+	var e envelope
+	if err := json.Unmarshal([]byte(msg), &e); err != nil {
+		return ctx, msg
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(e.Trace)), e.Payload
+}
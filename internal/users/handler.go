@@ -0,0 +1,527 @@
+package users
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultSearchLimit   = 20
+	maxSearchLimit       = 100
+	maxDisplayNameLength = 64
+	maxBioLength         = 500
+	maxAvatarSize        = 2 << 20
+)
+
+var avatarTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+type Handler struct {
+	service *Service
+}
+
+func NewHandler(service *Service) *Handler {
+	return &Handler{service: service}
+}
+
+func userIDFromRequest(r *http.Request) (string, bool) {
+	claims, ok := r.Context().Value("userClaims").(jwt.MapClaims)
+	if !ok {
+		return "", false
+	}
+	userID := fmt.Sprintf("%v", claims["user_id"])
+	if userID == "" || userID == "<nil>" {
+		return "", false
+	}
+	return userID, true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// @Summary Мой профиль
+// @Description GET возвращает профиль текущего пользователя, PATCH обновляет display_name, bio, timezone
+// @Description (пустая строка очищает поле) и discoverable (видимость в поиске).
+// @Description DELETE ставит в очередь удаление аккаунта и отвечает 202 с задачей; статус доступен на /me/jobs/{id}
+// @Description до завершения, после чего все токены аккаунта перестают действовать (401), а WebSocket закрывается.
+// @Description При privacy.deletion_policy: anonymize текст сообщений сохраняется без данных автора, при delete — удаляется.
+// @Description Только для сессии: API-токены получают 403.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param body body ProfileUpdate false "Fields to update (PATCH)"
+// @Success 200 {object} Me
+// @Failure 400 {string} string "Invalid request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "API tokens are not allowed"
+// @Router /me [get]
+// @Router /me [patch]
+// @Router /me [delete]
+func (h *Handler) Me(w http.ResponseWriter, r *http.Request) {
+	userID, ok := userIDFromRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var (
+		me  *Me
+		err error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		me, err = h.service.GetMe(r.Context(), userID)
+	case http.MethodDelete:
+		h.deleteAccount(w, r, userID)
+		return
+	case http.MethodPatch:
+		var upd ProfileUpdate
+		if err := json.NewDecoder(r.Body).Decode(&upd); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if msg := validateProfileUpdate(&upd); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		me, err = h.service.UpdateProfile(r.Context(), userID, upd)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if errors.Is(err, ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to handle profile request", "error", err)
+		http.Error(w, "Failed to load profile", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, me)
+}
+
+func validateProfileUpdate(upd *ProfileUpdate) string {
+	if upd.DisplayName != nil {
+		name := strings.TrimSpace(*upd.DisplayName)
+		upd.DisplayName = &name
+		if utf8.RuneCountInString(name) > maxDisplayNameLength {
+			return fmt.Sprintf("display_name must be at most %d characters long", maxDisplayNameLength)
+		}
+	}
+	if upd.Bio != nil && utf8.RuneCountInString(*upd.Bio) > maxBioLength {
+		return fmt.Sprintf("bio must be at most %d characters long", maxBioLength)
+	}
+	if upd.Timezone != nil && *upd.Timezone != "" {
+		if _, err := time.LoadLocation(*upd.Timezone); err != nil {
+			return "timezone must be an IANA time zone name, e.g. Europe/Moscow"
+		}
+	}
+	return ""
+}
+
+// @Summary Загрузить аватар
+// @Description Загружает аватар (PNG, JPEG, GIF или WebP до 2 МБ) в хранилище вложений
+// @Tags users
+// @Accept multipart/form-data
+// @Produce json
+// @Security BearerAuth
+// @Param file formData file true "Avatar image"
+// @Success 200 {object} Me
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "API tokens are not allowed"
+// @Router /me/avatar [put]
+func (h *Handler) Avatar(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, ok := userIDFromRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAvatarSize+(64<<10))
+	if err := r.ParseMultipartForm(maxAvatarSize); err != nil {
+		http.Error(w, "Could not parse multipart form", http.StatusBadRequest)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "File is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxAvatarSize+1))
+	if err != nil || len(data) > maxAvatarSize {
+		http.Error(w, "Avatar must be at most 2 MB", http.StatusBadRequest)
+		return
+	}
+	if !avatarTypes[http.DetectContentType(data)] {
+		http.Error(w, "Avatar must be a PNG, JPEG, GIF or WebP image", http.StatusBadRequest)
+		return
+	}
+
+	me, err := h.service.SetAvatar(r.Context(), userID, header.Filename, bytes.NewReader(data))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save avatar", "error", err)
+		http.Error(w, "Could not save avatar", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, me)
+}
+
+// @Summary Профиль пользователя
+// @Description GET /users/{id} возвращает публичный профиль, GET /users/{id}/avatar — изображение аватара
+// @Tags users
+// @Produce json
+// @Security BearerAuth
+// @Param id path string true "User ID"
+// @Success 200 {object} models.Profile
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Insufficient scope"
+// @Failure 404 {string} string "User not found"
+// @Router /users/{id} [get]
+func (h *Handler) User(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/users/"), "/")
+	userID := parts[0]
+	if userID == "" || len(parts) > 2 || (len(parts) == 2 && parts[1] != "avatar") {
+		http.NotFound(w, r)
+		return
+	}
+	if _, err := uuid.Parse(userID); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 2 {
+		h.serveAvatar(w, r, userID)
+		return
+	}
+
+	profile, err := h.service.GetProfile(r.Context(), userID)
+	if errors.Is(err, ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load profile", "profile_id", userID, "error", err)
+		http.Error(w, "Failed to load profile", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, profile)
+}
+
+func (h *Handler) serveAvatar(w http.ResponseWriter, r *http.Request, userID string) {
+	avatar, err := h.service.OpenAvatar(r.Context(), userID)
+	if errors.Is(err, ErrUserNotFound) {
+		http.Error(w, "Avatar not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to open avatar", "profile_id", userID, "error", err)
+		http.Error(w, "Failed to load avatar", http.StatusInternalServerError)
+		return
+	}
+	defer avatar.Close()
+
+	data, err := io.ReadAll(io.LimitReader(avatar, maxAvatarSize))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to read avatar", "profile_id", userID, "error", err)
+		http.Error(w, "Failed to load avatar", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	w.Write(data)
+}
+
+// swagger:model DirectoryPage
+type DirectoryPage struct {
+	Users []DirectoryEntry `json:"users"`
+	// NextOffset is set when more results may follow.
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+// @Summary Поиск пользователей
+// @Description Ищет пользователей по началу email или имени, а также по похожести (триграммы).
+// @Description Скрытые из каталога, неподтверждённые, боты и заблокированные пользователи не возвращаются
+// @Tags users
+// @Produce json
+// @Security BearerAuth
+// @Param q query string true "Search query"
+// @Param limit query int false "Page size (default 20, max 100)"
+// @Param offset query int false "Offset from a previous next_offset"
+// @Success 200 {object} DirectoryPage
+// @Failure 400 {string} string "Bad request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Insufficient scope"
+// @Router /users [get]
+func (h *Handler) Search(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, ok := userIDFromRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	params := r.URL.Query()
+	q := strings.TrimSpace(params.Get("q"))
+	if q == "" {
+		http.Error(w, "Query parameter q is required", http.StatusBadRequest)
+		return
+	}
+	limit, offset := defaultSearchLimit, 0
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxSearchLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if v := params.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	entries, err := h.service.SearchUsers(r.Context(), userID, q, limit, offset)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to search users", "error", err)
+		http.Error(w, "Failed to search users", http.StatusInternalServerError)
+		return
+	}
+	page := DirectoryPage{Users: entries}
+	if len(entries) == limit {
+		next := offset + limit
+		page.NextOffset = &next
+	}
+	writeJSON(w, page)
+}
+
+// @Summary Блокировки и заглушённые пользователи
+// @Description GET /blocks — список заблокированных, POST /blocks/{user_id} — заблокировать, DELETE /blocks/{user_id} — разблокировать.
+// @Description Заблокированные не могут писать вам, их публичные сообщения и онлайн-статус скрыты.
+// @Description /mutes работает так же, но скрывает только публичные сообщения
+// @Tags users
+// @Produce json
+// @Security BearerAuth
+// @Param user_id path string true "User ID"
+// @Success 200 {array} models.UserSummary
+// @Success 204 "Done"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "API tokens are not allowed"
+// @Failure 404 {string} string "User not found"
+// @Router /blocks [get]
+// @Router /blocks/{user_id} [post]
+// @Router /blocks/{user_id} [delete]
+// @Router /mutes [get]
+// @Router /mutes/{user_id} [post]
+// @Router /mutes/{user_id} [delete]
+func (h *Handler) Relations(w http.ResponseWriter, r *http.Request) {
+	userID, ok := userIDFromRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	kind, targetID, _ := strings.Cut(path, "/")
+	switch kind {
+	case "blocks":
+		kind = RelationBlock
+	case "mutes":
+		kind = RelationMute
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if targetID != "" {
+		if _, err := uuid.Parse(targetID); err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	var err error
+	switch {
+	case r.Method == http.MethodGet && targetID == "":
+		list, err := h.service.ListRelations(r.Context(), userID, kind)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to list relations", "kind", kind, "error", err)
+			http.Error(w, "Failed to list users", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, list)
+		return
+	case (r.Method == http.MethodPost || r.Method == http.MethodPut) && targetID != "":
+		err = h.service.SetRelation(r.Context(), userID, targetID, kind)
+	case r.Method == http.MethodDelete && targetID != "":
+		err = h.service.RemoveRelation(r.Context(), userID, targetID, kind)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if errors.Is(err, ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update relation", "kind", kind, "error", err)
+		http.Error(w, "Failed to update", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) deleteAccount(w http.ResponseWriter, r *http.Request, userID string) {
+	job, err := h.service.StartJob(r.Context(), userID, JobDelete)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to queue account deletion", "error", err)
+		http.Error(w, "Failed to delete account", http.StatusInternalServerError)
+		return
+	}
+	writeJobAccepted(w, job)
+}
+
+func writeJobAccepted(w http.ResponseWriter, job *Job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/me/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// @Summary Экспорт персональных данных
+// @Description Архив ZIP с профилем (profile.json), сообщениями (messages.json) и вложениями (attachments/).
+// @Description Экспорт выполняется в фоне: POST запускает новый экспорт, GET отдаёт архив последнего завершённого
+// @Description экспорта, а если его ещё нет — запускает экспорт. Пока задача выполняется, ответ 202 с задачей.
+// @Tags users
+// @Produce application/zip
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {file} file "Export archive"
+// @Success 202 {object} Job
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "API tokens are not allowed"
+// @Router /me/export [get]
+// @Router /me/export [post]
+func (h *Handler) Export(w http.ResponseWriter, r *http.Request) {
+	userID, ok := userIDFromRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var (
+		job *Job
+		err error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		job, err = h.service.LatestExport(r.Context(), userID)
+		if errors.Is(err, ErrJobNotFound) || (err == nil && job.Status == JobFailed) {
+			job, err = h.service.StartJob(r.Context(), userID, JobExport)
+		}
+	case http.MethodPost:
+		job, err = h.service.StartJob(r.Context(), userID, JobExport)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to start export", "error", err)
+		http.Error(w, "Failed to export data", http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodPost || job.Status != JobDone {
+		writeJobAccepted(w, job)
+		return
+	}
+
+	archive, err := h.service.OpenExport(job)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to open export", "job_id", job.ID, "error", err)
+		http.Error(w, "Export not available", http.StatusNotFound)
+		return
+	}
+	defer archive.Close()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="export.zip"`)
+	w.Header().Set("Cache-Control", "private, no-store")
+	if _, err := io.Copy(w, archive); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to send export", "job_id", job.ID, "error", err)
+	}
+}
+
+// @Summary Статус фоновой задачи
+// @Description Статус экспорта или удаления аккаунта: pending, running, done или failed
+// @Tags users
+// @Produce json
+// @Security BearerAuth
+// @Param id path string true "Job ID"
+// @Success 200 {object} Job
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 404 {string} string "Job not found"
+// @Router /me/jobs/{id} [get]
+func (h *Handler) Jobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, ok := userIDFromRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	jobID := strings.TrimPrefix(r.URL.Path, "/me/jobs/")
+	if _, err := uuid.Parse(jobID); err != nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	job, err := h.service.GetJob(r.Context(), userID, jobID)
+	if errors.Is(err, ErrJobNotFound) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load job", "job_id", jobID, "error", err)
+		http.Error(w, "Failed to load job", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, job)
+}
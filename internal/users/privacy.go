@@ -0,0 +1,509 @@
+package users
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"RealtimeChat/internal/shared"
+)
+
+const (
+	JobExport = "export"
+	JobDelete = "delete"
+
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+var ErrJobNotFound = errors.New("job not found")
+
+// Job is a background export or deletion of an account.
+type Job struct {
+	ID         string     `json:"id"`
+	Kind       string     `json:"kind" example:"export"`
+	Status     string     `json:"status" example:"pending"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// DownloadURL is set on finished exports.
+	DownloadURL string `json:"download_url,omitempty"`
+
+	userID     string
+	resultPath *string
+}
+
+const jobColumns = `id, user_id, kind, status, COALESCE(error, ''), result_path, created_at, finished_at`
+
+func scanJob(row interface{ Scan(...interface{}) error }) (*Job, error) {
+	var job Job
+	err := row.Scan(&job.ID, &job.userID, &job.Kind, &job.Status, &job.Error, &job.resultPath, &job.CreatedAt, &job.FinishedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if job.Kind == JobExport && job.Status == JobDone {
+		job.DownloadURL = "/me/export"
+	}
+	return &job, nil
+}
+
+// StartJob queues a job for userID. A job of the same kind that is still
+// pending or running is returned instead of queueing a second one.
+func (s *Service) StartJob(ctx context.Context, userID, kind string) (*Job, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + jobColumns + ` FROM account_jobs
+        WHERE user_id = $1 AND kind = $2 AND status IN ('pending', 'running')
+        ORDER BY created_at DESC LIMIT 1`
+	job, err := scanJob(s.db.QueryRowContext(ctx, query, userID, kind))
+	if !errors.Is(err, ErrJobNotFound) {
+		return job, err
+	}
+
+	query = `INSERT INTO account_jobs (user_id, kind) VALUES ($1, $2) RETURNING ` + jobColumns
+	job, err = scanJob(s.db.QueryRowContext(ctx, query, userID, kind))
+	if err != nil {
+		return nil, err
+	}
+	s.wakeJobs()
+	return job, nil
+}
+
+func (s *Service) GetJob(ctx context.Context, userID, jobID string) (*Job, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	query := `SELECT ` + jobColumns + ` FROM account_jobs WHERE id = $1 AND user_id = $2`
+	return scanJob(s.db.QueryRowContext(ctx, query, jobID, userID))
+}
+
+// LatestExport returns the most recent export job of userID.
+func (s *Service) LatestExport(ctx context.Context, userID string) (*Job, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	query := `SELECT ` + jobColumns + ` FROM account_jobs
+        WHERE user_id = $1 AND kind = 'export'
+        ORDER BY created_at DESC LIMIT 1`
+	return scanJob(s.db.QueryRowContext(ctx, query, userID))
+}
+
+// OpenExport opens the archive produced by a finished export job.
+func (s *Service) OpenExport(job *Job) (io.ReadCloser, error) {
+	if job.Kind != JobExport || job.Status != JobDone || job.resultPath == nil {
+		return nil, ErrJobNotFound
+	}
+	return s.storage.Open(*job.resultPath)
+}
+
+func (s *Service) wakeJobs() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// RunJobs processes queued account jobs until ctx is cancelled. Jobs are
+// claimed with SKIP LOCKED, so several instances can run it side by side.
+func (s *Service) RunJobs(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for s.runNextJob(ctx) {
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// runNextJob runs one pending job and reports whether there was one.
+func (s *Service) runNextJob(ctx context.Context) bool {
+	claimCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+        UPDATE account_jobs SET status = 'running', started_at = NOW()
+        WHERE id = (
+            SELECT id FROM account_jobs WHERE status = 'pending'
+            ORDER BY created_at LIMIT 1 FOR UPDATE SKIP LOCKED
+        )
+        RETURNING ` + jobColumns
+	job, err := scanJob(s.db.QueryRowContext(claimCtx, query))
+	if errors.Is(err, ErrJobNotFound) {
+		return false
+	}
+	if err != nil {
+		slog.Error("Failed to claim account job", "error", err)
+		return false
+	}
+
+	var resultPath string
+	switch job.Kind {
+	case JobExport:
+		resultPath, err = s.exportAccount(ctx, job.userID)
+	case JobDelete:
+		err = s.deleteAccount(ctx, job.userID)
+	default:
+		err = fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+	if err != nil && ctx.Err() != nil {
+		// Interrupted by shutdown: hand the job to the next instance.
+		s.requeueJob(job)
+		return false
+	}
+	s.finishJob(job, resultPath, err)
+	return true
+}
+
+func (s *Service) requeueJob(job *Job) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	query := `UPDATE account_jobs SET status = 'pending', started_at = NULL WHERE id = $1`
+	if _, err := s.db.ExecContext(ctx, query, job.ID); err != nil {
+		slog.Error("Failed to requeue account job", "job_id", job.ID, "error", err)
+		return
+	}
+	slog.Info("Account job interrupted, requeued", "job_id", job.ID, "kind", job.Kind)
+}
+
+func (s *Service) finishJob(job *Job, resultPath string, jobErr error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	status, errText := JobDone, ""
+	if jobErr != nil {
+		slog.Error("Account job failed", "job_id", job.ID, "kind", job.Kind, "error", jobErr)
+		status, errText = JobFailed, "internal error"
+	}
+	query := `
+        UPDATE account_jobs SET status = $2, result_path = NULLIF($3, ''), error = NULLIF($4, ''), finished_at = NOW()
+        WHERE id = $1`
+	if _, err := s.db.ExecContext(ctx, query, job.ID, status, resultPath, errText); err != nil {
+		slog.Error("Failed to update account job", "job_id", job.ID, "error", err)
+		return
+	}
+
+	// Only the newest archive is kept.
+	if job.Kind == JobExport && status == JobDone {
+		s.removeOldExports(ctx, job.userID, job.ID)
+	}
+}
+
+func (s *Service) removeOldExports(ctx context.Context, userID, keepID string) {
+	query := `
+        UPDATE account_jobs j SET result_path = NULL
+        FROM (
+            SELECT id, result_path FROM account_jobs
+            WHERE user_id = $1 AND kind = 'export' AND id <> $2 AND result_path IS NOT NULL
+            FOR UPDATE
+        ) old
+        WHERE j.id = old.id
+        RETURNING old.result_path`
+	rows, err := s.db.QueryContext(ctx, query, userID, keepID)
+	if err != nil {
+		slog.Error("Failed to clean up old exports", "user_id", userID, "error", err)
+		return
+	}
+	defer rows.Close()
+	s.deleteFiles(scanPaths(rows))
+}
+
+// exportProfile is profile.json in the export archive.
+type exportProfile struct {
+	Me
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"`
+	TwoFactor       bool       `json:"two_factor_enabled"`
+}
+
+type exportMessage struct {
+	ID              string             `json:"id"`
+	AuthorID        string             `json:"author_id"`
+	RecipientUserID *string            `json:"recipient_user_id,omitempty"`
+	Content         *string            `json:"content"`
+	CreatedAt       time.Time          `json:"created_at"`
+	Attachments     []exportAttachment `json:"attachments,omitempty"`
+}
+
+type exportAttachment struct {
+	FileName string `json:"file_name"`
+	MimeType string `json:"mime_type"`
+	// File is the path of the file inside the archive.
+	File string `json:"file"`
+
+	path string
+}
+
+// exportAccount writes a ZIP archive with the profile, every message the
+// user sent or received directly, and the user's attachments, and returns
+// its storage path.
+func (s *Service) exportAccount(ctx context.Context, userID string) (string, error) {
+	me, err := s.GetMe(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	profile := exportProfile{Me: *me}
+	err = s.db.QueryRowContext(ctx,
+		`SELECT email_verified_at, totp_enabled_at IS NOT NULL FROM users WHERE id = $1`, userID,
+	).Scan(&profile.EmailVerifiedAt, &profile.TwoFactor)
+	if err != nil {
+		return "", err
+	}
+
+	messages, err := s.exportMessages(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp("", "export-*.zip")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	zw := zip.NewWriter(tmp)
+	if err := writeZipJSON(zw, "profile.json", profile); err != nil {
+		return "", err
+	}
+	if err := writeZipJSON(zw, "messages.json", messages); err != nil {
+		return "", err
+	}
+	for _, msg := range messages {
+		for _, a := range msg.Attachments {
+			if err := s.copyToZip(zw, a.File, a.path); err != nil {
+				return "", err
+			}
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return s.storage.Save(fmt.Sprintf("export_%s.zip", userID), tmp)
+}
+
+func (s *Service) exportMessages(ctx context.Context, userID string) ([]*exportMessage, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT m.id, m.user_id, m.recipient_user_id, m.content, m.created_at,
+               a.id, a.file_name, a.mime_type, a.file_path
+        FROM messages m
+        LEFT JOIN attachments a ON a.message_id = m.id AND a.user_id = $1
+        WHERE m.user_id = $1 OR m.recipient_user_id = $1
+        ORDER BY m.created_at, m.id
+    `, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []*exportMessage
+	for rows.Next() {
+		var msg exportMessage
+		var attachmentID, fileName, mimeType, filePath *string
+		err := rows.Scan(&msg.ID, &msg.AuthorID, &msg.RecipientUserID, &msg.Content, &msg.CreatedAt,
+			&attachmentID, &fileName, &mimeType, &filePath)
+		if err != nil {
+			return nil, err
+		}
+		if n := len(messages); n == 0 || messages[n-1].ID != msg.ID {
+			messages = append(messages, &msg)
+		}
+		if attachmentID != nil {
+			last := messages[len(messages)-1]
+			last.Attachments = append(last.Attachments, exportAttachment{
+				FileName: *fileName,
+				MimeType: *mimeType,
+				File:     "attachments/" + *attachmentID + "_" + filepath.Base(*fileName),
+				path:     *filePath,
+			})
+		}
+	}
+	return messages, rows.Err()
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v interface{}) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (s *Service) copyToZip(zw *zip.Writer, name, path string) error {
+	src, err := s.storage.Open(path)
+	if err != nil {
+		// A missing file should not make the whole export fail.
+		slog.Warn("Export: failed to open file", "path", path, "error", err)
+		return nil
+	}
+	defer src.Close()
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, src)
+	return err
+}
+
+// deleteAccount erases the personal data of userID. The users row is kept
+// as an anonymous tombstone because messages of other users may reference
+// it; what happens to the user's own messages depends on
+// privacy.deletion_policy. All tokens of the account are invalidated and its
+// open WebSocket connections closed.
+func (s *Service) deleteAccount(ctx context.Context, userID string) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var files []string
+	collect := func(query string) error {
+		rows, err := tx.QueryContext(ctx, query, userID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		files = append(files, scanPaths(rows)...)
+		return rows.Err()
+	}
+
+	if err := collect(`DELETE FROM attachments WHERE user_id = $1 RETURNING file_path`); err != nil {
+		return err
+	}
+	if err := collect(`SELECT result_path FROM account_jobs WHERE user_id = $1 AND result_path IS NOT NULL`); err != nil {
+		return err
+	}
+	if err := collect(`SELECT avatar_path FROM users WHERE id = $1 AND avatar_path IS NOT NULL`); err != nil {
+		return err
+	}
+	var bots []string
+	rows, err := tx.QueryContext(ctx, `SELECT id FROM users WHERE owner_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		bots = append(bots, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	statements := []string{
+		// Bots of the user stay as authors of their messages but lose their tokens.
+		`DELETE FROM api_tokens WHERE user_id = $1 OR user_id IN (SELECT id FROM users WHERE owner_id = $1)`,
+		`DELETE FROM recovery_codes WHERE user_id = $1`,
+		`DELETE FROM user_identities WHERE user_id = $1`,
+		`DELETE FROM email_verification_tokens WHERE user_id = $1`,
+		`DELETE FROM login_attempts WHERE user_id = $1`,
+		`DELETE FROM user_blocks WHERE blocker_id = $1 OR blocked_id = $1`,
+		`UPDATE account_jobs SET result_path = NULL WHERE user_id = $1`,
+		`UPDATE users SET
+            email = 'deleted-' || id || '@deleted.invalid',
+            password_hash = '!',
+            display_name = NULL,
+            avatar_path = NULL,
+            bio = NULL,
+            timezone = NULL,
+            discoverable = FALSE,
+            email_verified_at = NULL,
+            totp_secret = NULL,
+            totp_enabled_at = NULL,
+            totp_last_counter = NULL,
+            status_text = NULL,
+            status_expires_at = NULL,
+            last_seen_at = NULL,
+            deleted_at = NOW(),
+            updated_at = NOW()
+        WHERE id = $1`,
+	}
+	if s.cfg.Privacy.DeletionPolicy == "delete" {
+		statements = append(statements, `DELETE FROM messages WHERE user_id = $1`)
+	}
+	for _, query := range statements {
+		if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.deleteFiles(files)
+	// Closes the WebSocket connections of the user and of their bots, whose
+	// API tokens are gone. The account is deleted by now, so a failure must
+	// not fail the job; AccountDeleted still rejects the tokens.
+	for _, id := range append(bots, userID) {
+		if err := shared.RevokeUserTokens(ctx, id); err != nil {
+			slog.ErrorContext(ctx, "Failed to revoke tokens of deleted account", "user_id", id, "error", err)
+		}
+	}
+	return nil
+}
+
+// AccountDeleted reports whether the account of userID was deleted, so that
+// its session tokens stop working even once the revocation marker is gone.
+// Unknown users count as deleted.
+func (s *Service) AccountDeleted(ctx context.Context, userID string) (bool, error) {
+    ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+    defer cancel()
+    var deleted bool
+    err := s.db.QueryRowContext(ctx, `SELECT deleted_at IS NOT NULL FROM users WHERE id = $1`, userID).Scan(&deleted)
+    if errors.Is(err, sql.ErrNoRows) {
+        return true, nil
+    }
+    return deleted, err
+}
+
+func scanPaths(rows *sql.Rows) []string {
+	var paths []string
+	for rows.Next() {
+		var path *string
+		if err := rows.Scan(&path); err != nil {
+			slog.Error("Failed to scan file path", "error", err)
+			continue
+		}
+		if path != nil && *path != "" {
+			paths = append(paths, *path)
+		}
+	}
+	return paths
+}
+
+func (s *Service) deleteFiles(paths []string) {
+	for _, path := range paths {
+		if err := s.storage.Delete(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Failed to remove file", "path", path, "error", err)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package users
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"RealtimeChat/internal/auth/models"
+	"RealtimeChat/internal/config"
+	"RealtimeChat/internal/shared"
+)
+
+var ErrUserNotFound = errors.New("user not found")
+
+type Service struct {
+	db      *shared.DB
+	cfg     *config.Config
+	storage shared.Storage
+	// wake nudges RunJobs when a job is queued.
+	wake chan struct{}
+}
+
+func NewService(db *shared.DB, cfg *config.Config, storage shared.Storage) *Service {
+	return &Service{db: db, cfg: cfg, storage: storage, wake: make(chan struct{}, 1)}
+}
+
+// Me is the profile of the authenticated user, which also carries their email.
+type Me struct {
+	models.Profile
+	Email string `json:"email"`
+	// Discoverable controls whether the user appears in directory search.
+	Discoverable bool `json:"discoverable"`
+}
+
+// ProfileUpdate holds the fields of a PATCH; nil leaves a field unchanged and
+// an empty string clears it.
+type ProfileUpdate struct {
+	DisplayName  *string `json:"display_name"`
+	Bio          *string `json:"bio"`
+	Timezone     *string `json:"timezone"`
+	Discoverable *bool   `json:"discoverable"`
+}
+
+const profileColumns = `id, email, user_type, display_name, avatar_path, bio, timezone, discoverable, created_at`
+
+func scanProfile(row interface{ Scan(...interface{}) error }) (*Me, error) {
+	var me Me
+	var displayName, avatarPath, bio, timezone *string
+	err := row.Scan(&me.ID, &me.Email, &me.UserType, &displayName, &avatarPath, &bio, &timezone, &me.Discoverable, &me.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if displayName != nil {
+		me.DisplayName = *displayName
+	}
+	if bio != nil {
+		me.Bio = *bio
+	}
+	if timezone != nil {
+		me.Timezone = *timezone
+	}
+	me.AvatarURL = models.AvatarURL(me.ID, avatarPath)
+	return &me, nil
+}
+
+func (s *Service) GetMe(ctx context.Context, userID string) (*Me, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	query := `SELECT ` + profileColumns + ` FROM users WHERE id = $1`
+	return scanProfile(s.db.QueryRowContext(ctx, query, userID))
+}
+
+func (s *Service) GetProfile(ctx context.Context, userID string) (*models.Profile, error) {
+	me, err := s.GetMe(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &me.Profile, nil
+}
+
+func (s *Service) UpdateProfile(ctx context.Context, userID string, upd ProfileUpdate) (*Me, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	query := `
+        UPDATE users SET
+            display_name = CASE WHEN $2::text IS NULL THEN display_name ELSE NULLIF($2, '') END,
+            bio          = CASE WHEN $3::text IS NULL THEN bio ELSE NULLIF($3, '') END,
+            timezone     = CASE WHEN $4::text IS NULL THEN timezone ELSE NULLIF($4, '') END,
+            discoverable = COALESCE($5, discoverable),
+            updated_at   = NOW()
+        WHERE id = $1
+        RETURNING ` + profileColumns
+	return scanProfile(s.db.QueryRowContext(ctx, query, userID, upd.DisplayName, upd.Bio, upd.Timezone, upd.Discoverable))
+}
+
+// SetAvatar stores a new avatar and removes the previous one from storage.
+func (s *Service) SetAvatar(ctx context.Context, userID, fileName string, r io.Reader) (*Me, error) {
+	path, err := s.storage.Save(fileName, r)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var oldPath *string
+	query := `
+        UPDATE users u SET avatar_path = $2, updated_at = NOW()
+        FROM (SELECT avatar_path FROM users WHERE id = $1 FOR UPDATE) old
+        WHERE u.id = $1
+        RETURNING old.avatar_path
+    `
+	err = s.db.QueryRowContext(ctx, query, userID, path).Scan(&oldPath)
+	if err != nil {
+		if delErr := s.storage.Delete(path); delErr != nil {
+			slog.ErrorContext(ctx, "SetAvatar: failed to remove file", "path", path, "error", delErr)
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	if oldPath != nil && *oldPath != "" {
+		if err := s.storage.Delete(*oldPath); err != nil {
+			slog.ErrorContext(ctx, "SetAvatar: failed to remove old avatar", "path", *oldPath, "error", err)
+		}
+	}
+	return s.GetMe(ctx, userID)
+}
+
+func (s *Service) OpenAvatar(ctx context.Context, userID string) (io.ReadCloser, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var path *string
+	err := s.db.QueryRowContext(ctx, `SELECT avatar_path FROM users WHERE id = $1`, userID).Scan(&path)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && (path == nil || *path == "")) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.storage.Open(*path)
+}
+
+// DirectoryEntry is a search result. The email is included because it is
+// what the messaging endpoints address users by; users who do not want it
+// found turn off discoverable.
+type DirectoryEntry struct {
+	models.UserSummary
+	Email string `json:"email"`
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SearchUsers finds discoverable users whose email or display name starts
+// with or resembles query. Prefix matches rank first, then trigram
+// similarity. Unverified accounts, bots and users blocked by or blocking the
+// searcher are excluded.
+func (s *Service) SearchUsers(ctx context.Context, searcherID, query string, limit, offset int) ([]DirectoryEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	q := strings.ToLower(strings.TrimSpace(query))
+	sqlQuery := `
+        SELECT u.id, u.email, u.display_name, u.avatar_path
+        FROM users u
+        WHERE u.discoverable
+          AND u.email_verified_at IS NOT NULL
+          AND u.user_type <> 'bot'
+          AND u.id <> $1
+          AND (
+                lower(u.email) LIKE $3 || '%'
+             OR lower(u.display_name) LIKE $3 || '%'
+             OR lower(u.email) % $2
+             OR lower(u.display_name) % $2
+          )
+          AND NOT EXISTS (
+                SELECT 1 FROM user_blocks b
+                WHERE b.kind = 'block'
+                  AND ((b.blocker_id = $1 AND b.blocked_id = u.id)
+                    OR (b.blocker_id = u.id AND b.blocked_id = $1))
+          )
+        ORDER BY
+            (lower(u.email) LIKE $3 || '%' OR COALESCE(lower(u.display_name) LIKE $3 || '%', FALSE)) DESC,
+            GREATEST(similarity(lower(u.email), $2), COALESCE(similarity(lower(u.display_name), $2), 0)) DESC,
+            u.email
+        LIMIT $4 OFFSET $5
+    `
+	rows, err := s.db.QueryContext(ctx, sqlQuery, searcherID, q, likeEscaper.Replace(q), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []DirectoryEntry{}
+	for rows.Next() {
+		var e DirectoryEntry
+		var displayName, avatarPath *string
+		if err := rows.Scan(&e.ID, &e.Email, &displayName, &avatarPath); err != nil {
+			return nil, err
+		}
+		e.UserSummary = models.UserSummary{ID: e.ID, AvatarURL: models.AvatarURL(e.ID, avatarPath)}
+		if displayName != nil {
+			e.DisplayName = *displayName
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Kinds of user relations stored in user_blocks.
+const (
+	RelationBlock = "block"
+	RelationMute  = "mute"
+)
+
+// SetRelation blocks or mutes targetID on behalf of userID. A block replaces
+// an existing mute and vice versa.
+func (s *Service) SetRelation(ctx context.Context, userID, targetID, kind string) error {
+	if userID == targetID {
+		return ErrUserNotFound
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+        INSERT INTO user_blocks (blocker_id, blocked_id, kind)
+        SELECT $1, id, $3 FROM users WHERE id = $2
+        ON CONFLICT (blocker_id, blocked_id) DO UPDATE SET kind = EXCLUDED.kind, created_at = NOW()
+    `
+	res, err := s.db.ExecContext(ctx, query, userID, targetID, kind)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *Service) RemoveRelation(ctx context.Context, userID, targetID, kind string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `DELETE FROM user_blocks WHERE blocker_id = $1 AND blocked_id = $2 AND kind = $3`
+	_, err := s.db.ExecContext(ctx, query, userID, targetID, kind)
+	return err
+}
+
+func (s *Service) ListRelations(ctx context.Context, userID, kind string) ([]models.UserSummary, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	query := `
+        SELECT u.id, u.display_name, u.avatar_path
+        FROM user_blocks b JOIN users u ON u.id = b.blocked_id
+        WHERE b.blocker_id = $1 AND b.kind = $2
+        ORDER BY b.created_at DESC
+    `
+	rows, err := s.db.QueryContext(ctx, query, userID, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []models.UserSummary{}
+	for rows.Next() {
+		var u models.UserSummary
+		var displayName, avatarPath *string
+		if err := rows.Scan(&u.ID, &displayName, &avatarPath); err != nil {
+			return nil, err
+		}
+		u.AvatarURL = models.AvatarURL(u.ID, avatarPath)
+		if displayName != nil {
+			u.DisplayName = *displayName
+		}
+		res = append(res, u)
+	}
+	return res, rows.Err()
+}
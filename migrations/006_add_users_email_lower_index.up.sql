@@ -0,0 +1,3 @@
+-- Emails are normalized to lowercase on registration; older rows may still be
+-- mixed-case, so lookups go through lower(email).
+CREATE INDEX IF NOT EXISTS idx_users_email_lower ON users (lower(email));
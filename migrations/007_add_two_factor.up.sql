@@ -0,0 +1,16 @@
+-- totp_secret is set on enrollment; 2FA is active only once totp_enabled_at is set.
+ALTER TABLE users
+ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64) NULL,
+ADD COLUMN IF NOT EXISTS totp_enabled_at TIMESTAMP NULL,
+ADD COLUMN IF NOT EXISTS totp_last_counter BIGINT NULL;
+
+CREATE TABLE IF NOT EXISTS recovery_codes
+(
+    id         UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id    UUID        NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash  VARCHAR(64) NOT NULL,
+    used_at    TIMESTAMP NULL,
+    created_at TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes (user_id);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS login_attempts
+(
+    id         UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    email      VARCHAR(255) NULL,
+    user_id    UUID NULL REFERENCES users(id) ON DELETE SET NULL,
+    ip         VARCHAR(64)  NOT NULL,
+    reason     VARCHAR(32)  NOT NULL,
+    created_at TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_attempts_email ON login_attempts (email, created_at);
+CREATE INDEX IF NOT EXISTS idx_login_attempts_ip ON login_attempts (ip, created_at);
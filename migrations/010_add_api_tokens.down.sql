@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS api_tokens;
+
+ALTER TABLE users
+DROP COLUMN IF EXISTS owner_id,
+DROP COLUMN IF EXISTS user_type;
@@ -0,0 +1,19 @@
+ALTER TABLE users
+ADD COLUMN IF NOT EXISTS user_type VARCHAR(16) NOT NULL DEFAULT 'human',
+ADD COLUMN IF NOT EXISTS owner_id UUID NULL REFERENCES users(id) ON DELETE CASCADE;
+
+CREATE TABLE IF NOT EXISTS api_tokens
+(
+    id           UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id      UUID         NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name         VARCHAR(100) NOT NULL,
+    token_hash   VARCHAR(64)  NOT NULL UNIQUE,
+    token_prefix VARCHAR(16)  NOT NULL,
+    scopes       TEXT[]       NOT NULL,
+    expires_at   TIMESTAMP NULL,
+    last_used_at TIMESTAMP NULL,
+    revoked_at   TIMESTAMP NULL,
+    created_at   TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens (user_id);
@@ -0,0 +1,5 @@
+ALTER TABLE users
+DROP COLUMN IF EXISTS display_name,
+DROP COLUMN IF EXISTS avatar_path,
+DROP COLUMN IF EXISTS bio,
+DROP COLUMN IF EXISTS timezone;
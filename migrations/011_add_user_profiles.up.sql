@@ -0,0 +1,5 @@
+ALTER TABLE users
+ADD COLUMN IF NOT EXISTS display_name VARCHAR(64) NULL,
+ADD COLUMN IF NOT EXISTS avatar_path VARCHAR(255) NULL,
+ADD COLUMN IF NOT EXISTS bio TEXT NULL,
+ADD COLUMN IF NOT EXISTS timezone VARCHAR(64) NULL;
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS user_blocks;
+
+DROP INDEX IF EXISTS idx_users_display_name_trgm;
+DROP INDEX IF EXISTS idx_users_email_trgm;
+
+ALTER TABLE users
+DROP COLUMN IF EXISTS discoverable;
@@ -0,0 +1,5 @@
+-- Mutes have no meaning without the kind column.
+DELETE FROM user_blocks WHERE kind <> 'block';
+
+ALTER TABLE user_blocks
+DROP COLUMN IF EXISTS kind;
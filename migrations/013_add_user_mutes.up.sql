@@ -0,0 +1,4 @@
+-- A mute only hides the muted user's public messages from the muter; a block
+-- additionally stops direct messages and presence in both directions.
+ALTER TABLE user_blocks
+ADD COLUMN IF NOT EXISTS kind VARCHAR(8) NOT NULL DEFAULT 'block';
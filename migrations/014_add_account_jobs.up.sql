@@ -0,0 +1,18 @@
+ALTER TABLE users
+ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP NULL;
+
+CREATE TABLE IF NOT EXISTS account_jobs
+(
+    id          UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id     UUID         NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    kind        VARCHAR(16)  NOT NULL,
+    status      VARCHAR(16)  NOT NULL DEFAULT 'pending',
+    result_path VARCHAR(255) NULL,
+    error       TEXT         NULL,
+    created_at  TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    started_at  TIMESTAMP    NULL,
+    finished_at TIMESTAMP    NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_account_jobs_user_id ON account_jobs (user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_account_jobs_pending ON account_jobs (created_at) WHERE status = 'pending';
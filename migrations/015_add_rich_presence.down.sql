@@ -0,0 +1,6 @@
+ALTER TABLE users
+DROP COLUMN IF EXISTS presence_state,
+DROP COLUMN IF EXISTS status_text,
+DROP COLUMN IF EXISTS status_expires_at,
+DROP COLUMN IF EXISTS last_seen_at,
+DROP COLUMN IF EXISTS last_seen_visibility;
@@ -0,0 +1,8 @@
+-- presence_state is what the user chose to show while connected:
+-- online, away, dnd or invisible. Offline is derived from the heartbeat.
+ALTER TABLE users
+ADD COLUMN IF NOT EXISTS presence_state VARCHAR(16) NOT NULL DEFAULT 'online',
+ADD COLUMN IF NOT EXISTS status_text VARCHAR(100) NULL,
+ADD COLUMN IF NOT EXISTS status_expires_at TIMESTAMP NULL,
+ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMP NULL,
+ADD COLUMN IF NOT EXISTS last_seen_visibility VARCHAR(16) NOT NULL DEFAULT 'everyone';
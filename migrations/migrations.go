@@ -0,0 +1,9 @@
+// Package migrations embeds the SQL migrations. Files are named
+// <version>_<name>.up.sql and <version>_<name>.down.sql; versions must be
+// unique and applied migrations must never be edited.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS